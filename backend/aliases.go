@@ -0,0 +1,331 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// normalizeName ger den jämförelseform som märken och modeller matchas på. Skiftläge,
+// blanksteg och skiljetecken ignoreras, så "KTM", "Ktm" och "K.T.M." blir "ktm" och
+// "SX-F 450", "SX F 450" och "SXF450" blir "450 sxf". Namnet delas i stället där
+// bokstäver och siffror möts och delarna sorteras, så "450 SX-F" matchar också.
+func normalizeName(name string) string {
+	var tokens []string
+	var current []rune
+	var prev rune
+
+	for _, r := range strings.ToLower(name) {
+		// Blanksteg och övriga tecken (punkt, bindestreck, snedstreck ...) tas bort
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			continue
+		}
+		if len(current) > 0 && unicode.IsDigit(r) != unicode.IsDigit(prev) {
+			tokens = append(tokens, string(current))
+			current = current[:0]
+		}
+		current = append(current, r)
+		prev = r
+	}
+	if len(current) > 0 {
+		tokens = append(tokens, string(current))
+	}
+
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+// normalizedColumns är kolumnerna som håller normalizeName av en annan kolumn
+var normalizedColumns = []struct{ table, source, normalized string }{
+	{"brands", "name", "normalized_name"},
+	{"models", "name", "normalized_name"},
+	{"brand_aliases", "alias", "normalized"},
+	{"model_aliases", "alias", "normalized"},
+}
+
+// backfillNormalizedNames fyller i normalized_name för märken och modeller som
+// skapades innan kolumnen fanns och räknar om normaliserade namn och alias som
+// sparades med en äldre version av normalizeName
+func backfillNormalizedNames(db *sql.DB) error {
+	for _, c := range normalizedColumns {
+		rows, err := db.Query(`SELECT id, ` + c.source + `, ` + c.normalized + ` FROM ` + c.table)
+		if err != nil {
+			return err
+		}
+
+		names := map[int]string{}
+		for rows.Next() {
+			var id int
+			var name string
+			var normalized sql.NullString
+			if err := rows.Scan(&id, &name, &normalized); err != nil {
+				rows.Close()
+				return err
+			}
+			if !normalized.Valid || normalized.String != normalizeName(name) {
+				names[id] = name
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, name := range names {
+			_, err := db.Exec(`UPDATE `+c.table+` SET `+c.normalized+` = $1 WHERE id = $2`, normalizeName(name), id)
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+				// unique_violation: ett annat alias har redan samma normaliserade form
+				log.Printf("Keeping old normalized form of %s %d (%q): %v", c.table, id, name, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// findBrand letar upp ett befintligt märke via alias eller normaliserat namn och
+// returnerar dess id och kanoniska namn. Alias går före eftersom de är uttryckligen satta.
+func findBrand(q queryer, name string) (int, string, error) {
+	var id int
+	var canonical string
+	err := q.QueryRow(`
+		SELECT b.id, b.name FROM (
+			SELECT brand_id AS id, 0 AS priority FROM brand_aliases WHERE normalized = $1
+			UNION ALL
+			SELECT id, 1 FROM brands WHERE normalized_name = $1
+		) matches
+		JOIN brands b ON b.id = matches.id
+		ORDER BY matches.priority, b.id
+		LIMIT 1
+	`, normalizeName(name)).Scan(&id, &canonical)
+	return id, canonical, err
+}
+
+// findModel letar upp en befintlig modell för märket via alias eller normaliserat namn
+func findModel(q queryer, brandID int, name string) (int, string, error) {
+	var id int
+	var canonical string
+	err := q.QueryRow(`
+		SELECT mo.id, mo.name FROM (
+			SELECT model_id AS id, 0 AS priority FROM model_aliases WHERE brand_id = $1 AND normalized = $2
+			UNION ALL
+			SELECT id, 1 FROM models WHERE brand_id = $1 AND normalized_name = $2
+		) matches
+		JOIN models mo ON mo.id = matches.id
+		ORDER BY matches.priority, mo.id
+		LIMIT 1
+	`, brandID, normalizeName(name)).Scan(&id, &canonical)
+	return id, canonical, err
+}
+
+// aliasKind beskriver skillnaderna mellan märkes- och modellalias
+type aliasKind struct {
+	name        string // "brand" eller "model", används i felmeddelanden
+	notFound    string
+	ownerTable  string
+	aliasTable  string
+	ownerColumn string
+	// conflictQuery hittar ett annat märke/en annan modell som redan heter som aliaset.
+	// $1 är ägarens id och $2 det normaliserade aliaset.
+	conflictQuery string
+	// insertQuery skapar aliaset. $1 är ägarens id, $2 aliaset och $3 den normaliserade formen.
+	insertQuery string
+}
+
+var brandAliases = aliasKind{
+	name:        "brand",
+	notFound:    "Brand not found",
+	ownerTable:  "brands",
+	aliasTable:  "brand_aliases",
+	ownerColumn: "brand_id",
+	conflictQuery: `
+		SELECT name FROM brands WHERE normalized_name = $2 AND id <> $1
+		UNION ALL
+		SELECT b.name FROM brand_aliases a JOIN brands b ON b.id = a.brand_id
+		WHERE a.normalized = $2 AND a.brand_id <> $1
+		LIMIT 1
+	`,
+	insertQuery: `
+		INSERT INTO brand_aliases (brand_id, alias, normalized)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`,
+}
+
+var modelAliases = aliasKind{
+	name:        "model",
+	notFound:    "Model not found",
+	ownerTable:  "models",
+	aliasTable:  "model_aliases",
+	ownerColumn: "model_id",
+	conflictQuery: `
+		SELECT o.name FROM models m JOIN models o ON o.brand_id = m.brand_id
+		WHERE m.id = $1 AND o.id <> $1 AND o.normalized_name = $2
+		UNION ALL
+		SELECT o.name FROM models m
+		JOIN model_aliases a ON a.brand_id = m.brand_id AND a.model_id <> $1
+		JOIN models o ON o.id = a.model_id
+		WHERE m.id = $1 AND a.normalized = $2
+		LIMIT 1
+	`,
+	insertQuery: `
+		INSERT INTO model_aliases (model_id, brand_id, alias, normalized)
+		SELECT id, brand_id, $2, $3 FROM models WHERE id = $1
+		RETURNING id
+	`,
+}
+
+func (k aliasKind) ownerExists(db *sql.DB, id int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+k.ownerTable+` WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+func getAliasesHandler(db *sql.DB, kind aliasKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid "+kind.name+" id", http.StatusBadRequest)
+			return
+		}
+
+		if ok, err := kind.ownerExists(db, id); err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, kind.notFound, http.StatusNotFound)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, alias, normalized FROM `+kind.aliasTable+`
+			WHERE `+kind.ownerColumn+` = $1
+			ORDER BY alias
+		`, id)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		aliases := []Alias{}
+		for rows.Next() {
+			var a Alias
+			if err := rows.Scan(&a.ID, &a.Alias, &a.Normalized); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			aliases = append(aliases, a)
+		}
+
+		json.NewEncoder(w).Encode(aliases)
+	}
+}
+
+// createAliasHandler lägger till ett alias. Ett alias som redan är namnet på eller ett
+// alias för ett annat märke/en annan modell ger 409; de två ska då slås ihop i stället.
+func createAliasHandler(db *sql.DB, kind aliasKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid "+kind.name+" id", http.StatusBadRequest)
+			return
+		}
+
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		a := Alias{Alias: strings.TrimSpace(body.Alias)}
+		a.Normalized = normalizeName(a.Alias)
+		if a.Normalized == "" {
+			http.Error(w, "alias is required", http.StatusBadRequest)
+			return
+		}
+
+		if ok, err := kind.ownerExists(db, id); err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, kind.notFound, http.StatusNotFound)
+			return
+		}
+
+		var other string
+		err = db.QueryRow(kind.conflictQuery, id, a.Normalized).Scan(&other)
+		if err == nil {
+			http.Error(w, fmt.Sprintf("Alias %q already matches %s %q", a.Alias, kind.name, other), http.StatusConflict)
+			return
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		err = db.QueryRow(kind.insertQuery, id, a.Alias, a.Normalized).Scan(&a.ID)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			// unique_violation: aliaset finns redan för samma märke/modell
+			http.Error(w, fmt.Sprintf("Alias %q already exists", a.Alias), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating alias: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+func deleteAliasHandler(db *sql.DB, kind aliasKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid "+kind.name+" id", http.StatusBadRequest)
+			return
+		}
+		aliasID, err := strconv.Atoi(mux.Vars(r)["alias"])
+		if err != nil {
+			http.Error(w, "Invalid alias id", http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`DELETE FROM `+kind.aliasTable+` WHERE id = $1 AND `+kind.ownerColumn+` = $2`, aliasID, id)
+		if err != nil {
+			log.Printf("Error deleting alias: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Alias not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// Stavningar ur riktiga leverantörsfiler som ska räknas som samma märke eller modell
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		want  string
+		names []string
+	}{
+		{"ktm", []string{"KTM", "Ktm", "K.T.M.", " ktm ", "K-T-M"}},
+		{"450 sxf", []string{"SX-F 450", "SX F 450", "SXF 450", "SXF450", "450 SX-F", "450SX-F", "sx-f450", "SX/F 450"}},
+		{"250 exc", []string{"EXC 250", "EXC250", "250 EXC", "E.X.C. 250"}},
+		{"450 crf r", []string{"CRF 450 R", "CRF450R", "CRF-450-R", "CRF 450R"}},
+		{"250 yz", []string{"YZ 250", "YZ250", "yz-250"}},
+		{"125 tc", []string{"TC 125", "TC125", "T.C 125"}},
+		{"gasgas", []string{"GasGas", "Gas Gas", "GAS-GAS", "Gas-Gas"}},
+		{"husqvarna", []string{"Husqvarna", "HUSQVARNA"}},
+		{"", []string{"", " ", "-/."}},
+	}
+	for _, tt := range tests {
+		for _, name := range tt.names {
+			if got := normalizeName(name); got != tt.want {
+				t.Errorf("normalizeName(%q) = %q, vill ha %q", name, got, tt.want)
+			}
+		}
+	}
+}
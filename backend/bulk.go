@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq"
+)
+
+const (
+	importMethodRows = "rows"
+	importMethodBulk = "bulk"
+)
+
+// bulkStep är en mängdbaserad fråga i bulk-importen. name används i felmeddelanden.
+type bulkStep struct {
+	name  string
+	query string
+	args  []any
+}
+
+// bulkInsertFromCSV är en snabbare variant av insertFromCSV för stora filer. Raderna
+// valideras i Go, strömmas in i en temporär staging-tabell med COPY och löses sedan
+// upp mot kategorier, produkter, märken, modeller, motorcyklar och kopplingar med
+// mängdbaserad SQL i stället för 6–8 frågor per rad.
+//
+// Ändringar och radutfall loggas på samma sätt som för radvis import så att
+// importhistorik och rollback fungerar likadant. Som vid radvis import är det första
+// raden som använder en ny kategori, produkt, märke, modell, motorcykel eller koppling
+// som räknas som created.
+func bulkInsertFromCSV(tx *sql.Tx, rows rowReader, cols columnMapping, rootCategory string, profile ImportProfile, opts importOptions) (*ImportReport, error) {
+	if opts.importID == 0 {
+		return nil, errors.New("bulk-import kräver ett import-id")
+	}
+
+	report := &ImportReport{Profile: profile.Name, Mode: opts.mode()}
+
+	rootCatID, err := getOrCreateRootCategory(tx, rootCategory, report, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var rootPath string
+	var rootLevel int
+	err = tx.QueryRow(`SELECT path, level FROM categories WHERE id = $1`, rootCatID).Scan(&rootPath, &rootLevel)
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte hämta root kategori: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE import_staging (
+			row_number INTEGER NOT NULL,
+			category TEXT NOT NULL,
+			brand TEXT NOT NULL,
+			model TEXT NOT NULL,
+			brand_key TEXT NOT NULL,
+			model_key TEXT NOT NULL,
+			brand_id INTEGER,
+			model_id INTEGER,
+			startyear INTEGER NOT NULL,
+			endyear INTEGER NOT NULL,
+			product_id TEXT NOT NULL,
+			product_name TEXT NOT NULL,
+			importer_name TEXT NOT NULL,
+			is_universal BOOLEAN NOT NULL
+		) ON COMMIT DROP
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte skapa staging-tabell: %w", err)
+	}
+
+	// Namnen jämförs i Go medan raderna strömmas in, så allt läses in före COPY
+	matcher, err := newNameMatcher(tx, opts.unknownNames, opts.matchThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := copyToStaging(tx, rows, cols, profile, matcher, report, opts)
+	if err != nil {
+		return nil, err
+	}
+	report.Suggestions = matcher.report()
+
+	for _, r := range held {
+		if err := recordImportRow(tx, opts.importID, r); err != nil {
+			return nil, &RowError{Row: r.Row, ProductID: r.ProductID, Err: fmt.Errorf("kunde inte logga raden: %w", err)}
+		}
+	}
+
+	steps := []bulkStep{
+		{"underkategorier", `
+			WITH new_categories AS (
+				SELECT nextval(pg_get_serial_sequence('categories', 'id'))::int AS id, name
+				FROM (SELECT DISTINCT category AS name FROM import_staging) s
+				WHERE NOT EXISTS (SELECT 1 FROM categories c WHERE c.name = s.name AND c.parent_id = $2)
+			), ins AS (
+				INSERT INTO categories (id, name, parent_id, path, level)
+				SELECT id, name, $2, $3::text || id || '/', $4 FROM new_categories
+				RETURNING id
+			)
+			INSERT INTO import_changes (import_id, entity, action, entity_id)
+			SELECT $1, 'category', 'created', id::text FROM ins
+		`, []any{opts.importID, rootCatID, rootPath, rootLevel + 1}},
+
+		{"produkttabell", `
+			CREATE TEMP TABLE import_staged_products (
+				product_id TEXT PRIMARY KEY,
+				product_name TEXT NOT NULL,
+				is_universal BOOLEAN NOT NULL,
+				category_id INTEGER NOT NULL,
+				description TEXT NOT NULL,
+				for_brand TEXT NOT NULL,
+				importer_name TEXT NOT NULL
+			) ON COMMIT DROP
+		`, nil},
+
+		// En produkt kan förekomma på många rader (en per motorcykel). Som vid radvis
+		// import tas kategori och beskrivning från första raden och namn från sista.
+		// Finns samma underkategori flera gånger används den äldsta, som i
+		// getOrCreateCategoryWithParent.
+		{"produkter", `
+			INSERT INTO import_staged_products
+			SELECT f.product_id, l.product_name, l.is_universal, c.id,
+				f.importer_name || ' - ' || f.product_name, f.brand, f.importer_name
+			FROM (SELECT DISTINCT ON (product_id) * FROM import_staging ORDER BY product_id, row_number) f
+			JOIN (SELECT DISTINCT ON (product_id) * FROM import_staging ORDER BY product_id, row_number DESC) l
+				ON l.product_id = f.product_id
+			JOIN (SELECT name, MIN(id) AS id FROM categories WHERE parent_id = $1 GROUP BY name) c
+				ON c.name = f.category
+		`, []any{rootCatID}},
+
+		{"nya produkter", `
+			INSERT INTO import_changes (import_id, entity, action, entity_id)
+			SELECT $1, 'product', 'created', sp.product_id
+			FROM import_staged_products sp
+			WHERE NOT EXISTS (SELECT 1 FROM products p WHERE p.id = sp.product_id)
+		`, []any{opts.importID}},
+
+		{"ändrade produkter", `
+			INSERT INTO import_changes (import_id, entity, action, entity_id, previous)
+			SELECT $1, 'product', 'updated', p.id,
+				jsonb_build_object('name', p.name, 'is_universal', p.is_universal, 'discontinued_at', p.discontinued_at)
+			FROM products p
+			JOIN import_staged_products sp ON sp.product_id = p.id
+			WHERE p.name IS DISTINCT FROM sp.product_name OR p.is_universal IS DISTINCT FROM sp.is_universal
+				OR p.discontinued_at IS NOT NULL
+		`, []any{opts.importID}},
+
+		{"produkter", `
+			INSERT INTO products (id, name, category_id, description, for_brand, is_universal, importer_name)
+			SELECT product_id, product_name, category_id, description, for_brand, is_universal, importer_name
+			FROM import_staged_products
+			ON CONFLICT (id) DO UPDATE
+			SET name = EXCLUDED.name, is_universal = EXCLUDED.is_universal, discontinued_at = NULL
+			WHERE products.name IS DISTINCT FROM EXCLUDED.name OR products.is_universal IS DISTINCT FROM EXCLUDED.is_universal
+				OR products.discontinued_at IS NOT NULL
+		`, nil},
+
+		// Märken och modeller matchas på alias och normaliserat namn (brand_key och
+		// model_key räknas ut med normalizeName). Bara de som saknas skapas, med
+		// stavningen från första raden, och varje staging-rad pekas sedan om till det
+		// kanoniska märket och den kanoniska modellen.
+		{"märken", `
+			WITH ins AS (
+				INSERT INTO brands (name, normalized_name)
+				SELECT DISTINCT ON (s.brand_key) s.brand, s.brand_key
+				FROM import_staging s
+				WHERE NOT s.is_universal
+				AND NOT EXISTS (SELECT 1 FROM brand_aliases a WHERE a.normalized = s.brand_key)
+				AND NOT EXISTS (SELECT 1 FROM brands b WHERE b.normalized_name = s.brand_key)
+				ORDER BY s.brand_key, s.row_number
+				ON CONFLICT (name) DO NOTHING
+				RETURNING id
+			)
+			INSERT INTO import_changes (import_id, entity, action, entity_id)
+			SELECT $1, 'brand', 'created', id::text FROM ins
+		`, []any{opts.importID}},
+
+		{"kanoniska märken", `
+			UPDATE import_staging s SET brand_id = m.id
+			FROM (
+				SELECT DISTINCT ON (normalized) normalized, id
+				FROM (
+					SELECT normalized, brand_id AS id, 0 AS priority FROM brand_aliases
+					UNION ALL
+					SELECT normalized_name, id, 1 FROM brands
+				) candidates
+				ORDER BY normalized, priority, id
+			) m
+			WHERE m.normalized = s.brand_key AND NOT s.is_universal
+		`, nil},
+
+		{"modeller", `
+			WITH ins AS (
+				INSERT INTO models (brand_id, name, normalized_name)
+				SELECT DISTINCT ON (s.brand_id, s.model_key) s.brand_id, s.model, s.model_key
+				FROM import_staging s
+				WHERE NOT s.is_universal
+				AND NOT EXISTS (
+					SELECT 1 FROM model_aliases a WHERE a.brand_id = s.brand_id AND a.normalized = s.model_key
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM models mo WHERE mo.brand_id = s.brand_id AND mo.normalized_name = s.model_key
+				)
+				ORDER BY s.brand_id, s.model_key, s.row_number
+				ON CONFLICT (brand_id, name) DO NOTHING
+				RETURNING id
+			)
+			INSERT INTO import_changes (import_id, entity, action, entity_id)
+			SELECT $1, 'model', 'created', id::text FROM ins
+		`, []any{opts.importID}},
+
+		{"kanoniska modeller", `
+			UPDATE import_staging s SET model_id = m.id
+			FROM (
+				SELECT DISTINCT ON (brand_id, normalized) brand_id, normalized, id
+				FROM (
+					SELECT brand_id, normalized, model_id AS id, 0 AS priority FROM model_aliases
+					UNION ALL
+					SELECT brand_id, normalized_name, id, 1 FROM models
+				) candidates
+				ORDER BY brand_id, normalized, priority, id
+			) m
+			WHERE m.brand_id = s.brand_id AND m.normalized = s.model_key AND NOT s.is_universal
+		`, nil},
+
+		{"motorcyklar", `
+			WITH ins AS (
+				INSERT INTO motorcycles (brand_id, model_id, startyear, endyear, full_name)
+				SELECT DISTINCT ON (s.brand_id, s.model_id, s.startyear, s.endyear)
+					s.brand_id, s.model_id, s.startyear, s.endyear,
+					b.name || ' ' || mo.name || ' ' || s.startyear || '-' || s.endyear
+				FROM import_staging s
+				JOIN brands b ON b.id = s.brand_id
+				JOIN models mo ON mo.id = s.model_id
+				WHERE NOT s.is_universal
+				ON CONFLICT (brand_id, model_id, startyear, endyear) DO NOTHING
+				RETURNING id
+			)
+			INSERT INTO import_changes (import_id, entity, action, entity_id)
+			SELECT $1, 'motorcycle', 'created', id::text FROM ins
+		`, []any{opts.importID}},
+
+		{"kopplingstabell", `
+			CREATE TEMP TABLE import_staged_fitments (
+				product_id TEXT NOT NULL,
+				motorcycle_id INTEGER NOT NULL,
+				PRIMARY KEY (product_id, motorcycle_id)
+			) ON COMMIT DROP
+		`, nil},
+
+		{"kopplingar", `
+			INSERT INTO import_staged_fitments
+			SELECT DISTINCT s.product_id, mc.id
+			FROM import_staging s
+			JOIN motorcycles mc ON mc.brand_id = s.brand_id AND mc.model_id = s.model_id
+				AND mc.startyear = s.startyear AND mc.endyear = s.endyear
+			WHERE NOT s.is_universal
+		`, nil},
+
+		{"produktkopplingar", `
+			WITH ins AS (
+				INSERT INTO product_compatibility (product_id, motorcycle_id)
+				SELECT product_id, motorcycle_id FROM import_staged_fitments
+				ON CONFLICT DO NOTHING
+				RETURNING product_id, motorcycle_id
+			)
+			INSERT INTO import_changes (import_id, entity, action, entity_id, related_id)
+			SELECT $1, 'fitment', 'created', product_id, motorcycle_id FROM ins
+		`, []any{opts.importID}},
+
+		// Varje skapad eller ändrad entitet knyts till den första staging-raden som
+		// använder den, eftersom det är den raden som skapar den vid radvis import
+		{"radutfall", `
+			WITH changes AS (
+				SELECT entity, action, entity_id, related_id, previous
+				FROM import_changes
+				WHERE import_id = $1 AND action IN ('created', 'updated')
+			), product_rows AS (
+				SELECT row_number, product_id, product_name, is_universal,
+					LAG(product_name) OVER w AS prev_name, LAG(is_universal) OVER w AS prev_universal
+				FROM (
+					SELECT DISTINCT ON (row_number) row_number, product_id, product_name, is_universal
+					FROM import_staging
+					ORDER BY row_number
+				) r
+				WINDOW w AS (PARTITION BY product_id ORDER BY row_number)
+			), row_changes AS (
+				SELECT MIN(s.row_number) AS row_number, 'created' AS action
+				FROM import_staging s
+				JOIN categories c ON c.name = s.category AND c.parent_id = $2
+				JOIN changes ch ON ch.entity = 'category' AND ch.entity_id = c.id::text
+				GROUP BY c.id
+				UNION ALL
+				SELECT MIN(s.row_number), 'created'
+				FROM import_staging s
+				JOIN changes ch ON ch.entity = 'product' AND ch.action = 'created' AND ch.entity_id = s.product_id
+				GROUP BY s.product_id
+				UNION ALL
+				-- Vid radvis import ändrar en rad produkten när namnet eller universalflaggan
+				-- skiljer sig från föregående rad, eller för första raden från produkten
+				-- före importen
+				SELECT pr.row_number, 'updated'
+				FROM product_rows pr
+				JOIN products p ON p.id = pr.product_id
+				LEFT JOIN changes ch ON ch.entity = 'product' AND ch.entity_id = pr.product_id
+				WHERE CASE
+					WHEN pr.prev_name IS NOT NULL THEN
+						pr.product_name IS DISTINCT FROM pr.prev_name OR pr.is_universal IS DISTINCT FROM pr.prev_universal
+					WHEN ch.action = 'created' THEN FALSE
+					WHEN ch.action = 'updated' THEN
+						pr.product_name IS DISTINCT FROM ch.previous->>'name'
+						OR pr.is_universal IS DISTINCT FROM (ch.previous->>'is_universal')::boolean
+						OR ch.previous->>'discontinued_at' IS NOT NULL
+					ELSE pr.product_name IS DISTINCT FROM p.name OR pr.is_universal IS DISTINCT FROM p.is_universal
+				END
+				UNION ALL
+				SELECT MIN(s.row_number), 'created'
+				FROM import_staging s
+				JOIN changes ch ON ch.entity = 'brand' AND ch.entity_id = s.brand_id::text
+				GROUP BY s.brand_id
+				UNION ALL
+				SELECT MIN(s.row_number), 'created'
+				FROM import_staging s
+				JOIN changes ch ON ch.entity = 'model' AND ch.entity_id = s.model_id::text
+				GROUP BY s.model_id
+				UNION ALL
+				SELECT MIN(s.row_number), 'created'
+				FROM import_staging s
+				JOIN motorcycles mc ON mc.brand_id = s.brand_id AND mc.model_id = s.model_id
+					AND mc.startyear = s.startyear AND mc.endyear = s.endyear
+				JOIN changes ch ON ch.entity = 'motorcycle' AND ch.entity_id = mc.id::text
+				GROUP BY mc.id
+				UNION ALL
+				SELECT MIN(s.row_number), 'created'
+				FROM import_staging s
+				JOIN motorcycles mc ON mc.brand_id = s.brand_id AND mc.model_id = s.model_id
+					AND mc.startyear = s.startyear AND mc.endyear = s.endyear
+				JOIN changes ch ON ch.entity = 'fitment' AND ch.entity_id = s.product_id AND ch.related_id = mc.id
+				GROUP BY s.product_id, mc.id
+			), outcomes AS (
+				SELECT row_number,
+					bool_or(action = 'created') AS created,
+					bool_or(action = 'updated') AS updated
+				FROM row_changes
+				GROUP BY row_number
+			)
+			INSERT INTO import_rows (import_id, row_number, outcome, product_id)
+			SELECT DISTINCT ON (s.row_number) $1, s.row_number,
+				CASE WHEN o.created THEN 'created' WHEN o.updated THEN 'updated' ELSE 'skipped' END,
+				s.product_id
+			FROM import_staging s
+			LEFT JOIN outcomes o ON o.row_number = s.row_number
+			ORDER BY s.row_number
+		`, []any{opts.importID, rootCatID}},
+	}
+
+	// Vid sync tas kopplingar som inte längre finns i filen bort och produkter som
+	// saknas markeras som utgångna, på samma sätt som syncCatalog gör för radvis import
+	if opts.sync {
+		steps = append(steps, []bulkStep{
+			{"borttagna kopplingar", `
+				WITH removed AS (
+					DELETE FROM product_compatibility pc
+					USING import_staged_products sp
+					WHERE pc.product_id = sp.product_id
+					AND NOT EXISTS (
+						SELECT 1 FROM import_staged_fitments f
+						WHERE f.product_id = pc.product_id AND f.motorcycle_id = pc.motorcycle_id
+					)
+					AND NOT EXISTS (
+						SELECT 1 FROM import_rows r
+						WHERE r.import_id = $1 AND r.product_id = pc.product_id AND r.outcome = 'held'
+					)
+					RETURNING pc.product_id, pc.motorcycle_id
+				)
+				INSERT INTO import_changes (import_id, entity, action, entity_id, related_id)
+				SELECT $1, 'fitment', 'deleted', product_id, motorcycle_id FROM removed
+			`, []any{opts.importID}},
+
+			{"utgångna produkter", `
+				WITH discontinued AS (
+					UPDATE products p SET discontinued_at = now()
+					FROM categories c
+					WHERE c.id = p.category_id
+					AND c.path LIKE $2 || '%'
+					AND p.importer_name IN (SELECT DISTINCT importer_name FROM import_staging)
+					AND p.discontinued_at IS NULL
+					AND NOT EXISTS (SELECT 1 FROM import_rows r WHERE r.import_id = $1 AND r.product_id = p.id)
+					RETURNING p.id
+				)
+				INSERT INTO import_changes (import_id, entity, action, entity_id)
+				SELECT $1, 'product', 'discontinued', id FROM discontinued
+			`, []any{opts.importID, rootPath}},
+		}...)
+	}
+
+	for _, step := range steps {
+		if _, err := tx.Exec(step.query, step.args...); err != nil {
+			return nil, fmt.Errorf("bulk-import av %s misslyckades: %w", step.name, err)
+		}
+	}
+
+	outcomes, err := tx.Query(`SELECT outcome, count(*) FROM import_rows WHERE import_id = $1 GROUP BY outcome`, opts.importID)
+	if err != nil {
+		return nil, err
+	}
+	defer outcomes.Close()
+
+	for outcomes.Next() {
+		var outcome string
+		var n int
+		if err := outcomes.Scan(&outcome, &n); err != nil {
+			return nil, err
+		}
+		switch outcome {
+		case rowCreated:
+			report.RowsCreated = n
+		case rowUpdated:
+			report.RowsUpdated = n
+		case rowSkipped:
+			report.RowsSkipped = n
+		case rowHeld:
+			report.RowsHeld = n
+		}
+	}
+	return report, outcomes.Err()
+}
+
+// copyToStaging validerar varje rad och strömmar den till staging-tabellen med COPY.
+// Rader som hålls för granskning av matcher hoppas över och returneras så att de kan
+// loggas när COPY är klar.
+func copyToStaging(tx *sql.Tx, rows rowReader, cols columnMapping, profile ImportProfile, matcher *nameMatcher, report *ImportReport, opts importOptions) ([]RowResult, error) {
+	stmt, err := tx.Prepare(pq.CopyIn("import_staging",
+		"row_number", "category", "brand", "model", "brand_key", "model_key", "startyear", "endyear",
+		"product_id", "product_name", "importer_name", "is_universal"))
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte starta COPY: %w", err)
+	}
+	defer stmt.Close()
+
+	var held []RowResult
+	for rowNum := 1; ; {
+		var row []string
+		row, rowNum, err = readRow(rows, rowNum)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.RowsTotal++
+
+		r, err := parseCSVRow(row, rowNum, cols, profile)
+		if err != nil {
+			return nil, &RowError{Row: r.num, ProductID: r.productID, Err: err, Invalid: true}
+		}
+
+		if _, reason := matcher.resolve(&r); reason != "" {
+			held = append(held, RowResult{Row: r.num, ProductID: r.productID, Held: reason})
+			if opts.progress != nil {
+				opts.progress(report.RowsTotal)
+			}
+			continue
+		}
+
+		// En lista av årsmodeller blir en staging-rad per intervall med samma radnummer
+		years := r.years
+		if r.isUniversal {
+			years = []ModelYearRange{{}}
+		}
+		brandKey, modelKey := normalizeName(r.brand), normalizeName(r.model)
+		for _, y := range years {
+			_, err = stmt.Exec(r.num, r.category, r.brand, r.model, brandKey, modelKey, y.StartYear, y.EndYear,
+				r.productID, r.productName, r.importerName, r.isUniversal)
+			if err != nil {
+				return nil, &RowError{Row: r.num, ProductID: r.productID, Err: err}
+			}
+		}
+
+		if opts.progress != nil {
+			opts.progress(report.RowsTotal)
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		return nil, fmt.Errorf("COPY till staging-tabellen misslyckades: %w", err)
+	}
+	return held, nil
+}
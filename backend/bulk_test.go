@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Samma underkategori kan finnas flera gånger under roten. Produkterna ska då hamna i
+// den äldsta i stället för att dubbleras i staging-tabellen.
+func TestBulkImportDuplicateCategoryNames(t *testing.T) {
+	db := testDB(t)
+
+	rootID, _, err := getOrCreateCategoryWithParent(db, "fjädrar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first, second int
+	for _, id := range []*int{&first, &second} {
+		err := db.QueryRow(`
+			INSERT INTO categories (name, parent_id, path, level) VALUES ('Bakfjädrar', $1, '', 1)
+			RETURNING id
+		`, rootID).Scan(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file := testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "100", "Fjäder", "Testimportören"},
+	})
+	importTestFile(t, db, file, true, importOptions{})
+
+	var categoryID int
+	if err := db.QueryRow(`SELECT category_id FROM products WHERE id = 'KT100'`).Scan(&categoryID); err != nil {
+		t.Fatal(err)
+	}
+	if categoryID != first {
+		t.Errorf("category_id = %d, vill ha den äldsta kategorin %d", categoryID, first)
+	}
+}
+
+// Bulk-importen ska ge samma radutfall som radvis import, även för rader som bara
+// skapar en kategori, ett märke eller en modell och för upprepade produktrader
+func TestBulkImportRowOutcomes(t *testing.T) {
+	db := testDB(t)
+
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "300", "Länk", "Testimportören"},
+	}), false, importOptions{})
+
+	file := testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Framfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "Husqvarna", "TC 125", "2019-2021", "200", "Dämpare", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "200", "Dämpare", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "300", "Länk, ny", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "300", "Länk, ny", "Testimportören"},
+	})
+
+	type importRow struct {
+		row       int
+		outcome   string
+		productID string
+	}
+	importRows := func(bulk bool) []importRow {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Importen rullas tillbaka så att båda vägarna utgår från samma katalog
+		defer tx.Rollback()
+
+		importID := createTestImport(t, tx, importModeUpsert)
+		if _, err := runTestImport(t, tx, file, bulk, importOptions{importID: importID}); err != nil {
+			t.Fatalf("bulk=%t: %v", bulk, err)
+		}
+
+		rows, err := tx.Query(`
+			SELECT row_number, outcome, product_id FROM import_rows WHERE import_id = $1 ORDER BY row_number
+		`, importID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var result []importRow
+		for rows.Next() {
+			var r importRow
+			if err := rows.Scan(&r.row, &r.outcome, &r.productID); err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, r)
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	want := []importRow{
+		{2, rowSkipped, "KT100"},
+		{3, rowCreated, "KT100"}, // modell, motorcykel och koppling
+		{4, rowSkipped, "KT100"},
+		{5, rowCreated, "KT100"}, // bara kategorin
+		{6, rowCreated, "KT200"},
+		{7, rowCreated, "KT200"}, // koppling
+		{8, rowUpdated, "KT300"},
+		{9, rowSkipped, "KT300"},
+	}
+	if got := importRows(false); !reflect.DeepEqual(got, want) {
+		t.Errorf("radvis import: %v, vill ha %v", got, want)
+	}
+	if got := importRows(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("bulk-import: %v, vill ha %v", got, want)
+	}
+}
+
+// BenchmarkInsert jämför radvis import och bulk-import av samma fil. Varje körning
+// rullas tillbaka så att alla börjar från en tom katalog.
+func BenchmarkInsert(b *testing.B) {
+	db := testDB(b)
+	file := testFile(generatedRows(500, 4))
+
+	for _, method := range []string{importMethodRows, importMethodBulk} {
+		b.Run(method, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tx, err := db.Begin()
+				if err != nil {
+					b.Fatal(err)
+				}
+				opts := importOptions{importID: createTestImport(b, tx, importModeUpsert)}
+				if _, err := runTestImport(b, tx, file, method == importMethodBulk, opts); err != nil {
+					b.Fatal(err)
+				}
+				tx.Rollback()
+			}
+		})
+	}
+}
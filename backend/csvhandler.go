@@ -1,233 +1,692 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"encoding/csv"
+	"errors"
 	"fmt"
-	"log"
-	"mime/multipart"
+	"io"
 	"strconv"
-	"strings"
+	"time"
 
-	"golang.org/x/text/encoding/charmap"
 	"golang.org/x/text/transform"
 )
 
-func csvreader(file multipart.File, db *sql.DB, rootCategory string) {
-	decoded := transform.NewReader(file, charmap.Windows1252.NewDecoder())
+// queryer är det gemensamma gränssnittet för *sql.DB och *sql.Tx
+type queryer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// rowReader är en källa som ger en rad i taget, t.ex. *csv.Reader
+type rowReader interface {
+	Read() ([]string, error)
+}
+
+// importSource är en öppnad leverantörsfil (CSV eller kalkylblad) där headern är
+// läst. Raderna läses sedan en i taget från rows.
+type importSource struct {
+	rows   rowReader
+	cols   columnMapping
+	format FileFormat
+	// closer stänger arket som rows läser ur, nil för CSV
+	closer io.Closer
+}
+
+// Close stänger arket i ett kalkylblad. Filen i sig stängs av anroparen.
+func (s *importSource) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// csvreader känner igen filens teckenkodning och avgränsare (om profilen anger "auto"),
+// läser headerraden och slår upp profilens kolumner. Resten av filen strömmas rad för rad.
+func csvreader(file io.Reader, profile ImportProfile) (*importSource, error) {
+	buffered := bufio.NewReaderSize(file, sniffSize)
+	sample, err := buffered.Peek(sniffSize)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("fel vid läsning av CSV: %w", err)
+	}
+	if len(sample) == 0 {
+		return nil, fmt.Errorf("filen är tom")
+	}
+
+	format, err := detectFormat(sample, profile)
+	if err != nil {
+		return nil, fmt.Errorf("fel i importprofil: %w", err)
+	}
+	enc, err := lookupEncoding(format.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("fel i importprofil: %w", err)
+	}
+	comma, err := parseDelimiter(format.Delimiter)
+	if err != nil {
+		return nil, fmt.Errorf("fel i importprofil: %w", err)
+	}
+
+	decoded := transform.NewReader(buffered, enc.NewDecoder())
 
 	reader := csv.NewReader(decoded)
-	reader.Comma = ';'
+	reader.Comma = comma
+	// Rader med fel antal kolumner rapporteras per rad i stället för att stoppa läsningen
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	format.Type = fileTypeCSV
+	return newImportSource(reader, profile, format)
+}
 
-	records, err := reader.ReadAll()
+// newImportSource läser headerraden och slår upp profilens kolumner i den
+func newImportSource(rows rowReader, profile ImportProfile, format FileFormat) (*importSource, error) {
+	header, err := rows.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("filen är tom")
+	}
 	if err != nil {
-		fmt.Println("Fel vid läsning av CSV:", err)
-		return
+		return nil, fmt.Errorf("fel vid läsning av filen: %w", err)
 	}
 
-	if len(records) < 1 {
-		fmt.Println("CSV-filen är tom")
-		return
+	cols, err := profile.resolveColumns(header)
+	if err != nil {
+		return nil, fmt.Errorf("profilen %s matchar inte filen: %w", profile.Name, err)
 	}
 
-	err = insertFromCSV(records, db, rootCategory)
+	return &importSource{rows: rows, cols: cols, format: format}, nil
+}
+
+// numberedRows är en rowReader som själv vet radnumret för den senast lästa raden,
+// t.ex. ett kalkylblad där tomma rader hoppas över men ändå räknas
+type numberedRows interface {
+	RowNumber() int
+}
+
+// readRow läser nästa rad och returnerar den med sitt nummer i filen, där headern är
+// rad 1. prev är numret på föregående rad.
+func readRow(rows rowReader, prev int) ([]string, int, error) {
+	row, err := rows.Read()
+	if err == io.EOF {
+		return nil, 0, err
+	}
 	if err != nil {
-		log.Println("Error when inserting: ", err)
+		return nil, 0, &RowError{Row: prev + 1, Err: fmt.Errorf("fel vid läsning av filen: %w", err), Invalid: true}
+	}
+	if n, ok := rows.(numberedRows); ok {
+		return row, n.RowNumber(), nil
+	}
+	return row, prev + 1, nil
+}
+
+// RowError beskriver vilken rad som stoppade en import och varför
+type RowError struct {
+	Row       int
+	ProductID string
+	Err       error
+	// Invalid är satt när raden i sig är felaktig, till skillnad från ett databasfel
+	Invalid bool
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("rad %d: %v", e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+type importOptions struct {
+	dryRun bool
+	// importID är satt för riktiga importer och används för att logga varje rad i import_rows
+	importID int
+	// progress anropas efter varje rad med antalet behandlade rader
+	progress func(processed int)
+	// sync tar bort det som inte längre finns i filen, se syncCatalog
+	sync bool
+	// unknownNames är create, map eller review och matchThreshold likheten som krävs
+	// för att ett okänt namn ska mappas eller hållas, se nameMatcher
+	unknownNames   string
+	matchThreshold float64
+}
+
+func (o importOptions) mode() string {
+	if o.sync {
+		return importModeSync
 	}
+	return importModeUpsert
 }
 
-func insertFromCSV(records [][]string, db *sql.DB, rootCategory string) error {
-	rootCatID, err := getOrCreateCategoryWithParent(db, rootCategory, nil)
+// csvRow är en validerad rad ur leverantörsfilen
+type csvRow struct {
+	num      int
+	category string
+	brand    string
+	model    string
+	// years är årsmodellerna som produkten passar, ett intervall per del i en lista
+	years        []ModelYearRange
+	productID    string
+	productName  string
+	importerName string
+	isUniversal  bool
+}
+
+// parseCSVRow plockar ut och validerar radens fält enligt profilen
+func parseCSVRow(row []string, rowNum int, cols columnMapping, profile ImportProfile) (csvRow, error) {
+	r := csvRow{num: rowNum}
+
+	if len(row) <= cols.maxIndex() {
+		return r, fmt.Errorf("raden har %d kolumner, profilen kräver minst %d", len(row), cols.maxIndex()+1)
+	}
+
+	r.category = row[cols.category]
+	r.brand = row[cols.brand]
+	r.model = row[cols.model]
+	modYears := row[cols.years]
+	r.productID = profile.CodePrefix + row[cols.productCode]
+	r.productName = row[cols.productName]
+	r.importerName = row[cols.importer]
+
+	if row[cols.productCode] == "" {
+		return r, fmt.Errorf("produktkod saknas")
+	}
+
+	r.isUniversal = r.brand == "" || r.model == "" || modYears == ""
+
+	if !r.isUniversal {
+		var err error
+		r.years, err = parseModelYears(modYears)
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// motorcycleName bygger motorcykelns fullständiga namn av märkets och modellens
+// kanoniska namn
+func motorcycleName(brand, model string, y ModelYearRange) string {
+	return brand + " " + model + " " + strconv.Itoa(y.StartYear) + "-" + strconv.Itoa(y.EndYear)
+}
+
+// idCache håller redan uppslagna id:n under en import så att återkommande
+// kategorier, märken, modeller och motorcyklar inte slås upp en gång per rad.
+// Märken och modeller nycklas på normaliserat namn.
+type idCache struct {
+	categories  map[string]int
+	brands      map[string]namedID
+	models      map[modelKey]namedID
+	motorcycles map[motorcycleKey]int
+}
+
+// namedID är ett uppslaget märke eller en modell med sitt kanoniska namn
+type namedID struct {
+	id   int
+	name string
+}
+
+type modelKey struct {
+	brandID    int
+	normalized string
+}
+
+type motorcycleKey struct {
+	modelID   int
+	startYear int
+	endYear   int
+}
+
+func newIDCache() *idCache {
+	return &idCache{
+		categories:  make(map[string]int),
+		brands:      make(map[string]namedID),
+		models:      make(map[modelKey]namedID),
+		motorcycles: make(map[motorcycleKey]int),
+	}
+}
+
+// insertFromCSV importerar alla rader via q. Vid en riktig import avbryts allt vid
+// första felaktiga rad så att anroparen kan rulla tillbaka transaktionen; vid dry-run
+// samlas valideringsfelen i rapporten i stället.
+func insertFromCSV(q queryer, rows rowReader, cols columnMapping, rootCategory string, profile ImportProfile, opts importOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: opts.dryRun, Profile: profile.Name, Mode: opts.mode()}
+	if opts.dryRun {
+		report.Diff = newImportDiff()
+	}
+
+	rootCatID, err := getOrCreateRootCategory(q, rootCategory, report, opts)
 	if err != nil {
-		return fmt.Errorf("kunde inte skapa/hämta root kategori: %w", err)
+		return nil, err
 	}
 
-	for i, row := range records {
-		if i == 0 {
-			continue
+	cache := newIDCache()
+	seen := newSyncSet()
+
+	matcher, err := newNameMatcher(q, opts.unknownNames, opts.matchThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	for rowNum := 1; ; {
+		var row []string
+		row, rowNum, err = readRow(rows, rowNum)
+		if err == io.EOF {
+			break
 		}
-		subCategoryName := row[0]
-		brandName := row[4]
-		modelName := row[5]
-		modYears := row[6]
-		productCode := "KT" + row[9]
-		productName := row[10]
-		companyName := row[18]
+		if err != nil {
+			return nil, err
+		}
+		report.RowsTotal++
 
-		// 1. Skapa/hämta underkategori med parent = "fjädrar"
-		subCatID, err := getOrCreateCategoryWithParent(db, subCategoryName, &rootCatID)
+		var result RowResult
+		parsed, err := parseCSVRow(row, rowNum, cols, profile)
 		if err != nil {
-			return fmt.Errorf("kunde inte skapa/hämta underkategori %s: %w", subCategoryName, err)
+			result = RowResult{Row: parsed.num, ProductID: parsed.productID, Error: err.Error()}
+		} else if mapped, held := matcher.resolve(&parsed); held != "" {
+			result = RowResult{Row: parsed.num, ProductID: parsed.productID, Held: held}
+		} else {
+			result, err = insertCSVRow(q, cache, parsed, rootCatID)
+			if err != nil {
+				return nil, &RowError{Row: result.Row, ProductID: result.ProductID, Err: err}
+			}
+			result.Mapped = mapped
+		}
+		if opts.sync {
+			seen.add(parsed, result.motorcycleIDs, result.Held != "" || result.Error != "")
+		}
+		if result.Error != "" && !opts.dryRun {
+			return nil, &RowError{Row: result.Row, ProductID: result.ProductID, Err: errors.New(result.Error), Invalid: true}
 		}
+		report.add(result)
 
-		isUniversal := brandName == "" || modelName == "" || modYears == ""
+		if opts.importID != 0 {
+			if err := recordImportRow(q, opts.importID, result); err != nil {
+				return nil, &RowError{Row: result.Row, ProductID: result.ProductID, Err: fmt.Errorf("kunde inte logga raden: %w", err)}
+			}
+		}
+		if err := report.record(q, opts, result.changes); err != nil {
+			return nil, &RowError{Row: result.Row, ProductID: result.ProductID, Err: err}
+		}
 
-		// 6. Skapa produkt
-		productID, err := getOrCreateProduct(db, productCode, productName, subCatID, brandName, isUniversal, companyName)
+		if opts.progress != nil {
+			opts.progress(report.RowsTotal)
+		}
+	}
+
+	report.Suggestions = matcher.report()
+
+	if opts.sync {
+		changes, err := syncCatalog(q, rootCatID, seen)
 		if err != nil {
-			return fmt.Errorf("kunde inte skapa/hämta produkt: %w", err)
+			return nil, err
+		}
+		if err := report.record(q, opts, changes); err != nil {
+			return nil, err
 		}
+	}
 
-		// 7. Koppla endast om det inte är en universal-produkt
-		if !isUniversal {
-			brandID, err := getOrCreateBrand(db, brandName)
-			if err != nil {
-				return fmt.Errorf("kunde inte skapa/hämta brand %s: %w", brandName, err)
+	return report, nil
+}
+
+// record loggar ändringarna i import_changes vid en riktig import och lägger dem i
+// rapportens diff vid dry-run
+func (rep *ImportReport) record(q queryer, opts importOptions, changes []importChange) error {
+	for _, c := range changes {
+		if opts.importID != 0 {
+			if err := recordImportChange(q, opts.importID, c); err != nil {
+				return fmt.Errorf("kunde inte logga ändringen: %w", err)
 			}
+		}
+		if rep.Diff != nil {
+			rep.Diff.add(c)
+		}
+	}
+	return nil
+}
 
-			modelID, err := getOrCreateModel(db, brandID, modelName)
-			if err != nil {
-				return fmt.Errorf("kunde inte skapa/hämta model %s: %w", modelName, err)
+func getOrCreateRootCategory(q queryer, rootCategory string, report *ImportReport, opts importOptions) (int, error) {
+	rootCatID, rootCreated, err := getOrCreateCategoryWithParent(q, rootCategory, nil)
+	if err != nil {
+		return 0, fmt.Errorf("kunde inte skapa/hämta root kategori: %w", err)
+	}
+	if rootCreated {
+		report.CreatedRootCategory = rootCategory
+		if opts.importID != 0 {
+			rootChange := importChange{entity: changeCategory, action: changeCreated, entityID: strconv.Itoa(rootCatID)}
+			if err := recordImportChange(q, opts.importID, rootChange); err != nil {
+				return 0, fmt.Errorf("kunde inte logga root kategori: %w", err)
 			}
+		}
+	}
+	return rootCatID, nil
+}
+
+// insertCSVRow importerar en validerad rad. Databasfel returneras som error
+func insertCSVRow(q queryer, cache *idCache, r csvRow, rootCatID int) (RowResult, error) {
+	result := RowResult{Row: r.num, ProductID: r.productID}
+
+	// 1. Skapa/hämta underkategori med parent = "fjädrar"
+	subCatID, ok := cache.categories[r.category]
+	if !ok {
+		var created bool
+		var err error
+		subCatID, created, err = getOrCreateCategoryWithParent(q, r.category, &rootCatID)
+		if err != nil {
+			return result, fmt.Errorf("kunde inte skapa/hämta underkategori %s: %w", r.category, err)
+		}
+		if created {
+			result.created("category", r.category)
+			result.changed(changeCategory, changeCreated, strconv.Itoa(subCatID), 0, nil)
+		}
+		cache.categories[r.category] = subCatID
+	}
+
+	// 6. Skapa produkt
+	productID, outcome, prev, err := getOrCreateProduct(q, r.productID, r.productName, subCatID, r.brand, r.isUniversal, r.importerName)
+	if err != nil {
+		return result, fmt.Errorf("kunde inte skapa/hämta produkt: %w", err)
+	}
+	switch outcome {
+	case productCreated:
+		result.created("product", productID)
+		result.changed(changeProduct, changeCreated, productID, 0, nil)
+	case productUpdated:
+		result.Updated = true
+		result.changed(changeProduct, changeUpdated, productID, 0, prev)
+	}
 
-			startYear, endYear := parseModelYears(modYears)
+	// 7. Koppla endast om det inte är en universal-produkt
+	if !r.isUniversal {
+		brandKey := normalizeName(r.brand)
+		brand, ok := cache.brands[brandKey]
+		if !ok {
+			var created bool
+			brand.id, brand.name, created, err = getOrCreateBrand(q, r.brand)
+			if err != nil {
+				return result, fmt.Errorf("kunde inte skapa/hämta brand %s: %w", r.brand, err)
+			}
+			if created {
+				result.created("brand", r.brand)
+				result.changed(changeBrand, changeCreated, strconv.Itoa(brand.id), 0, nil)
+			}
+			cache.brands[brandKey] = brand
+		}
 
-			fullname := brandName + " " + modelName + " " + strconv.Itoa(startYear) + "-" + strconv.Itoa(endYear)
-			motorcycleID, err := getOrCreateMotorcycle(db, brandID, modelID, startYear, endYear, fullname)
+		mKey := modelKey{brandID: brand.id, normalized: normalizeName(r.model)}
+		model, ok := cache.models[mKey]
+		if !ok {
+			var created bool
+			model.id, model.name, created, err = getOrCreateModel(q, brand.id, r.model)
 			if err != nil {
-				return fmt.Errorf("kunde inte skapa/hämta motorcycle: %w", err)
+				return result, fmt.Errorf("kunde inte skapa/hämta model %s: %w", r.model, err)
+			}
+			if created {
+				result.created("model", brand.name+" "+r.model)
+				result.changed(changeModel, changeCreated, strconv.Itoa(model.id), 0, nil)
+			}
+			cache.models[mKey] = model
+		}
+
+		// En lista av årsmodeller ger en motorcykel och en koppling per intervall
+		for _, y := range r.years {
+			fullname := motorcycleName(brand.name, model.name, y)
+			mcKey := motorcycleKey{modelID: model.id, startYear: y.StartYear, endYear: y.EndYear}
+			motorcycleID, ok := cache.motorcycles[mcKey]
+			if !ok {
+				var created bool
+				motorcycleID, created, err = getOrCreateMotorcycle(q, brand.id, model.id, y.StartYear, y.EndYear, fullname)
+				if err != nil {
+					return result, fmt.Errorf("kunde inte skapa/hämta motorcycle: %w", err)
+				}
+				if created {
+					result.created("motorcycle", fullname)
+					result.changed(changeMotorcycle, changeCreated, strconv.Itoa(motorcycleID), 0, nil)
+				}
+				cache.motorcycles[mcKey] = motorcycleID
 			}
 
-			err = insertProductCompatibility(db, productID, motorcycleID)
+			result.motorcycleIDs = append(result.motorcycleIDs, motorcycleID)
+			created, err := insertProductCompatibility(q, productID, motorcycleID)
 			if err != nil {
-				return fmt.Errorf("kunde inte skapa produkt_compatibility: %w", err)
+				return result, fmt.Errorf("kunde inte skapa produkt_compatibility: %w", err)
+			}
+			if created {
+				result.created("fitment", productID+" → "+fullname)
+				result.changed(changeFitment, changeCreated, productID, motorcycleID, nil)
 			}
 		}
 	}
 
-	return nil
+	return result, nil
 }
 
-func getOrCreateCategoryWithParent(db *sql.DB, name string, parentID *int) (int, error) {
+func getOrCreateCategoryWithParent(q queryer, name string, parentID *int) (int, bool, error) {
 	var id int
 
 	// Försök hämta kategori först
 	if parentID == nil {
-		err := db.QueryRow(`SELECT id FROM categories WHERE name = $1 AND parent_id IS NULL`, name).Scan(&id)
+		err := q.QueryRow(`SELECT id FROM categories WHERE name = $1 AND parent_id IS NULL ORDER BY id LIMIT 1`, name).Scan(&id)
 		if err == sql.ErrNoRows {
 			// Skapa kategori utan parent
-			err = db.QueryRow(`INSERT INTO categories(name, parent_id) VALUES($1, NULL) RETURNING id`, name).Scan(&id)
+			err = q.QueryRow(`INSERT INTO categories(name, parent_id) VALUES($1, NULL) RETURNING id`, name).Scan(&id)
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			// Uppdatera path och level för rotkategori
 			path := fmt.Sprintf("/%d/", id)
 			level := 0
-			_, err = db.Exec(`UPDATE categories SET path = $1, level = $2 WHERE id = $3`, path, level, id)
+			_, err = q.Exec(`UPDATE categories SET path = $1, level = $2 WHERE id = $3`, path, level, id)
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
+			return id, true, nil
 		}
-		return id, err
+		return id, false, err
 	} else {
 		// Hämta förälder path och level
 		var parentPath string
 		var parentLevel int
-		err := db.QueryRow(`SELECT path, level FROM categories WHERE id = $1`, *parentID).Scan(&parentPath, &parentLevel)
+		err := q.QueryRow(`SELECT path, level FROM categories WHERE id = $1`, *parentID).Scan(&parentPath, &parentLevel)
 		if err != nil {
-			return 0, err
+			return 0, false, err
 		}
 
-		err = db.QueryRow(`SELECT id FROM categories WHERE name = $1 AND parent_id = $2`, name, *parentID).Scan(&id)
+		err = q.QueryRow(`SELECT id FROM categories WHERE name = $1 AND parent_id = $2 ORDER BY id LIMIT 1`, name, *parentID).Scan(&id)
 		if err == sql.ErrNoRows {
 			// Skapa kategori med parent
-			err = db.QueryRow(`INSERT INTO categories(name, parent_id) VALUES($1, $2) RETURNING id`, name, *parentID).Scan(&id)
+			err = q.QueryRow(`INSERT INTO categories(name, parent_id) VALUES($1, $2) RETURNING id`, name, *parentID).Scan(&id)
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 
 			// Uppdatera path och level baserat på förälder
 			path := fmt.Sprintf("%s%d/", parentPath, id)
 			level := parentLevel + 1
-			_, err = db.Exec(`UPDATE categories SET path = $1, level = $2 WHERE id = $3`, path, level, id)
+			_, err = q.Exec(`UPDATE categories SET path = $1, level = $2 WHERE id = $3`, path, level, id)
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
+			return id, true, nil
 		}
-		return id, err
+		return id, false, err
 	}
 }
 
-func parseModelYears(modYearStr string) (int, int) {
-	var startyear, endyear int = 0, 9999
-	var err error
-
-	if strings.Contains(modYearStr, ">") {
-		trimmed := strings.Trim(modYearStr, ">")
-		startyear, err = strconv.Atoi(trimmed)
-		if err != nil {
-			fmt.Println("Error: ", err)
-		}
-	} else if strings.Contains(modYearStr, "-") {
-		splitstrs := strings.Split(modYearStr, "-")
-		startyear, err = strconv.Atoi(splitstrs[0])
-		if err != nil {
-			fmt.Println("Error: ", err)
-		}
-
-		endyear, err = strconv.Atoi(splitstrs[1])
-		if err != nil {
-			fmt.Println("Error: ", err)
-		}
+// getOrCreateBrand hittar märket via alias eller normaliserat namn och skapar det bara
+// om inget matchar. Det kanoniska namnet returneras så att motorcykelns namn blir
+// detsamma oavsett hur märket stavas i filen.
+func getOrCreateBrand(q queryer, brandName string) (int, string, bool, error) {
+	id, name, err := findBrand(q, brandName)
+	if err == nil {
+		return id, name, false, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", false, err
 	}
-	return startyear, endyear
-}
 
-func getOrCreateBrand(db *sql.DB, brandName string) (int, error) {
-	var id int
-	err := db.QueryRow(`INSERT INTO brands (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING id`, brandName).Scan(&id)
+	err = q.QueryRow(`
+		INSERT INTO brands (name, normalized_name) VALUES ($1, $2)
+		ON CONFLICT (name) DO NOTHING
+		RETURNING id
+	`, brandName, normalizeName(brandName)).Scan(&id)
 	if err == sql.ErrNoRows {
 		// raden fanns redan, hämta den manuellt
-		err = db.QueryRow(`SELECT id FROM brands WHERE name = $1`, brandName).Scan(&id)
+		err = q.QueryRow(`SELECT id FROM brands WHERE name = $1`, brandName).Scan(&id)
+		return id, brandName, false, err
 	}
-	return id, err
+	return id, brandName, err == nil, err
 }
 
-func getOrCreateModel(db *sql.DB, brandID int, modelName string) (int, error) {
-	var id int
-	err := db.QueryRow(`
-		INSERT INTO models(brand_id, name)
-		VALUES($1, $2)
-		ON CONFLICT (brand_id, name) DO UPDATE SET name = EXCLUDED.name
+// getOrCreateModel fungerar som getOrCreateBrand men inom ett märke
+func getOrCreateModel(q queryer, brandID int, modelName string) (int, string, bool, error) {
+	id, name, err := findModel(q, brandID, modelName)
+	if err == nil {
+		return id, name, false, err
+	}
+	if err != sql.ErrNoRows {
+		return 0, "", false, err
+	}
+
+	err = q.QueryRow(`
+		INSERT INTO models(brand_id, name, normalized_name)
+		VALUES($1, $2, $3)
+		ON CONFLICT (brand_id, name) DO NOTHING
 		RETURNING id
-	`, brandID, modelName).Scan(&id)
-	return id, err
+	`, brandID, modelName, normalizeName(modelName)).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = q.QueryRow(`SELECT id FROM models WHERE brand_id = $1 AND name = $2`, brandID, modelName).Scan(&id)
+		return id, modelName, false, err
+	}
+	return id, modelName, err == nil, err
 }
 
-func getOrCreateMotorcycle(db *sql.DB, brandID int, modelID int, startYear int, endYear int, fullname string) (int, error) {
+func getOrCreateMotorcycle(q queryer, brandID int, modelID int, startYear int, endYear int, fullname string) (int, bool, error) {
 	var id int
 
 	query := `
     	INSERT INTO motorcycles (brand_id, model_id, startyear, endyear, full_name)
     	VALUES ($1, $2, $3, $4, $5)
-    	ON CONFLICT (brand_id, model_id, startyear, endyear)
-    	DO UPDATE SET full_name = EXCLUDED.full_name
+    	ON CONFLICT (brand_id, model_id, startyear, endyear) DO NOTHING
     	RETURNING id
 	`
 
-	err := db.QueryRow(query, brandID, modelID, startYear, endYear, fullname).Scan(&id)
-	return id, err
+	err := q.QueryRow(query, brandID, modelID, startYear, endYear, fullname).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = q.QueryRow(`
+			UPDATE motorcycles SET full_name = $5
+			WHERE brand_id = $1 AND model_id = $2 AND startyear = $3 AND endyear = $4
+			RETURNING id
+		`, brandID, modelID, startYear, endYear, fullname).Scan(&id)
+		return id, false, err
+	}
+	return id, err == nil, err
+}
+
+type productOutcome int
+
+const (
+	productUnchanged productOutcome = iota
+	productCreated
+	productUpdated
+)
+
+// productState är de fält som en import kan skriva över på en befintlig produkt.
+// En utgången produkt som finns med i filen igen blir aktiv.
+type productState struct {
+	Name           string     `json:"name"`
+	IsUniversal    bool       `json:"is_universal"`
+	DiscontinuedAt *time.Time `json:"discontinued_at,omitempty"`
 }
 
-func getOrCreateProduct(db *sql.DB, productCode, productName string, subCatID int, brandName string, isUniversal bool, companyName string) (string, error) {
-	var id string
+// getOrCreateProduct returnerar även produktens tidigare värden när den uppdateras
+func getOrCreateProduct(q queryer, productCode, productName string, subCatID int, brandName string, isUniversal bool, companyName string) (string, productOutcome, *productState, error) {
+	var prev productState
+	exists := true
+	err := q.QueryRow(`SELECT name, is_universal, discontinued_at FROM products WHERE id = $1`, productCode).Scan(&prev.Name, &prev.IsUniversal, &prev.DiscontinuedAt)
+	if err == sql.ErrNoRows {
+		exists = false
+	} else if err != nil {
+		return "", productUnchanged, nil, err
+	}
 
+	// Uppdatera bara om något faktiskt har ändrats, annars returneras ingen rad
 	query := `
 	INSERT INTO products(id, name, category_id, description, for_brand, is_universal, importer_name)
 	VALUES($1, $2, $3, $4, $5, $6, $7)
-	ON CONFLICT (id) DO UPDATE 
-	SET name = EXCLUDED.name, is_universal = EXCLUDED.is_universal
+	ON CONFLICT (id) DO UPDATE
+	SET name = EXCLUDED.name, is_universal = EXCLUDED.is_universal, discontinued_at = NULL
+	WHERE products.name IS DISTINCT FROM EXCLUDED.name OR products.is_universal IS DISTINCT FROM EXCLUDED.is_universal
+		OR products.discontinued_at IS NOT NULL
 	RETURNING id;
 	`
-	err := db.QueryRow(query, productCode, productName, subCatID, companyName+" - "+productName, brandName, isUniversal, companyName).Scan(&id)
-	return id, err
+	var id string
+	err = q.QueryRow(query, productCode, productName, subCatID, companyName+" - "+productName, brandName, isUniversal, companyName).Scan(&id)
+	if err == sql.ErrNoRows {
+		return productCode, productUnchanged, nil, nil
+	}
+	if err != nil {
+		return "", productUnchanged, nil, err
+	}
+	if exists {
+		return id, productUpdated, &prev, nil
+	}
+	return id, productCreated, nil, nil
 }
 
-func insertProductCompatibility(db *sql.DB, productID string, motorcycleID int) error {
-	_, err := db.Exec(`
+func insertProductCompatibility(q queryer, productID string, motorcycleID int) (bool, error) {
+	res, err := q.Exec(`
 		INSERT INTO product_compatibility (product_id, motorcycle_id)
 		VALUES ($1, $2)
 		ON CONFLICT DO NOTHING
 	`, productID, motorcycleID)
-	return err
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r *RowResult) created(kind, name string) {
+	r.Created = append(r.Created, CreatedEntity{Kind: kind, Name: name})
+}
+
+func (r *RowResult) changed(entity, action, entityID string, relatedID int, previous any) {
+	r.changes = append(r.changes, importChange{entity: entity, action: action, entityID: entityID, relatedID: relatedID, previous: previous})
+}
+
+// add räknar radens utfall. Vid dry-run sorteras raden även in i rapportens listor;
+// vid riktiga importer finns detaljerna i import_rows och hålls inte i minnet.
+func (rep *ImportReport) add(r RowResult) {
+	switch r.outcome() {
+	case rowFailed:
+		rep.RowsFailed++
+	case rowCreated:
+		rep.RowsCreated++
+	case rowUpdated:
+		rep.RowsUpdated++
+	case rowSkipped:
+		rep.RowsSkipped++
+	case rowHeld:
+		rep.RowsHeld++
+	}
+
+	if !rep.DryRun {
+		return
+	}
+	if r.Error != "" {
+		rep.Errors = append(rep.Errors, r)
+		return
+	}
+	if r.Held != "" {
+		rep.HeldRows = append(rep.HeldRows, r)
+		return
+	}
+
+	if len(r.Created) > 0 {
+		rep.NewEntities = append(rep.NewEntities, r)
+	}
+	if r.Updated {
+		rep.UpdatedProducts = append(rep.UpdatedProducts, r)
+	}
 }
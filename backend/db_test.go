@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testDB öppnar databasen i TEST_DATABASE_URL, skapar schemat och tömmer alla tabeller
+// utom importprofilerna. Utan TEST_DATABASE_URL hoppas testet över. Databasen töms, så
+// den får inte innehålla något som ska sparas.
+func testDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL är inte satt")
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+
+	if err := createSchema(db); err != nil {
+		tb.Fatalf("kunde inte skapa schemat: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT quote_ident(tablename) FROM pg_tables
+		WHERE schemaname = current_schema() AND tablename <> 'import_profiles'
+	`)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			tb.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(`TRUNCATE ` + strings.Join(tables, ", ") + ` RESTART IDENTITY CASCADE`); err != nil {
+		tb.Fatalf("kunde inte tömma tabellerna: %v", err)
+	}
+	return db
+}
+
+// testProfile är standardprofilen, se createSchema
+var testProfile = ImportProfile{
+	Name:              defaultProfileName,
+	CategoryColumn:    "0",
+	BrandColumn:       "4",
+	ModelColumn:       "5",
+	YearsColumn:       "6",
+	ProductCodeColumn: "9",
+	ProductNameColumn: "10",
+	ImporterColumn:    "18",
+	CodePrefix:        "KT",
+	Delimiter:         ";",
+	Encoding:          "utf-8",
+}
+
+// testRow är en rad i en leverantörsfil enligt testProfile
+type testRow struct {
+	category, brand, model, years, code, name, importer string
+}
+
+// testFile bygger en leverantörsfil med header av raderna
+func testFile(rows []testRow) string {
+	var b strings.Builder
+	b.WriteString(strings.Repeat("col;", 18) + "col\n")
+	for _, r := range rows {
+		cols := make([]string, 19)
+		cols[0], cols[4], cols[5], cols[6] = r.category, r.brand, r.model, r.years
+		cols[9], cols[10], cols[18] = r.code, r.name, r.importer
+		b.WriteString(strings.Join(cols, ";") + "\n")
+	}
+	return b.String()
+}
+
+// createTestImport registrerar en pågående import och returnerar dess id
+func createTestImport(tb testing.TB, q queryer, mode string) int {
+	tb.Helper()
+
+	var id int
+	err := q.QueryRow(`
+		INSERT INTO imports (filename, root_category, profile, mode, state, started_at)
+		VALUES ('test.csv', 'fjädrar', $1, $2, $3, now())
+		RETURNING id
+	`, testProfile.Name, mode, jobRunning).Scan(&id)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return id
+}
+
+// runTestImport importerar filen radvis eller med bulk via tx
+func runTestImport(tb testing.TB, tx *sql.Tx, file string, bulk bool, opts importOptions) (*ImportReport, error) {
+	tb.Helper()
+
+	src, err := csvreader(strings.NewReader(file), testProfile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if bulk {
+		return bulkInsertFromCSV(tx, src.rows, src.cols, "fjädrar", testProfile, opts)
+	}
+	return insertFromCSV(tx, src.rows, src.cols, "fjädrar", testProfile, opts)
+}
+
+// importTestFile importerar filen i en egen transaktion och markerar importen som klar
+func importTestFile(tb testing.TB, db *sql.DB, file string, bulk bool, opts importOptions) *ImportReport {
+	tb.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if opts.importID == 0 {
+		opts.importID = createTestImport(tb, tx, opts.mode())
+	}
+	report, err := runTestImport(tb, tx, file, bulk, opts)
+	if err != nil {
+		tb.Fatalf("importen misslyckades: %v", err)
+	}
+	if _, err := tx.Exec(`UPDATE imports SET state = $1, finished_at = now() WHERE id = $2`, jobSucceeded, opts.importID); err != nil {
+		tb.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	return report
+}
+
+// generatedRows är en fil med products produkter som var och en passar bikes motorcyklar
+func generatedRows(products, bikes int) []testRow {
+	rows := make([]testRow, 0, products*bikes)
+	for p := 0; p < products; p++ {
+		for m := 0; m < bikes; m++ {
+			rows = append(rows, testRow{
+				category: fmt.Sprintf("Kategori %d", p%10),
+				brand:    fmt.Sprintf("Märke %d", m%5),
+				model:    fmt.Sprintf("Modell %d", m),
+				years:    fmt.Sprintf("%d-%d", 2010+m%5, 2015+m%5),
+				code:     fmt.Sprintf("%05d", p),
+				name:     fmt.Sprintf("Produkt %d", p),
+				importer: "Testimportören",
+			})
+		}
+	}
+	return rows
+}
+
+// callHandler anropar h med bodyn och URL-variablerna vars som routern skulle ha satt
+func callHandler(h http.HandlerFunc, method, target, body string, vars map[string]string) *httptest.ResponseRecorder {
+	req := mux.SetURLVars(httptest.NewRequest(method, target, strings.NewReader(body)), vars)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
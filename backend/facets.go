@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// productFacets är frågorna för facetterna i /products. %s är frågan med id:n för
+// produkterna som matchar filtren. Varje fråga returnerar värde, etikett och antal.
+var productFacets = map[string]string{
+	"category": `
+		SELECT c.id::text, c.name, COUNT(*)
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		WHERE p.id IN (%s)
+		GROUP BY c.id, c.name
+		ORDER BY COUNT(*) DESC, c.name`,
+	"importer": `
+		SELECT COALESCE(p.importer_name, ''), COALESCE(p.importer_name, ''), COUNT(*)
+		FROM products p
+		WHERE p.id IN (%s)
+		GROUP BY 1
+		ORDER BY COUNT(*) DESC, 1`,
+	"is_universal": `
+		SELECT COALESCE(p.is_universal, false)::text, COALESCE(p.is_universal, false)::text, COUNT(*)
+		FROM products p
+		WHERE p.id IN (%s)
+		GROUP BY 1
+		ORDER BY COUNT(*) DESC, 1`,
+	// Universalprodukter har inga motorcyklar och räknas inte här
+	"brand": `
+		SELECT b.id::text, b.name, COUNT(DISTINCT p.id)
+		FROM products p
+		JOIN product_compatibility pc ON pc.product_id = p.id
+		JOIN motorcycles m ON m.id = pc.motorcycle_id
+		JOIN brands b ON b.id = m.brand_id
+		WHERE p.id IN (%s)
+		GROUP BY b.id, b.name
+		ORDER BY COUNT(DISTINCT p.id) DESC, b.name`,
+}
+
+// parseFacets tolkar facets, en kommaseparerad lista med facetter
+func parseFacets(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	var facets []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := productFacets[name]; !ok {
+			return nil, fmt.Errorf("Invalid facet %q, expected category, importer, is_universal or brand", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			facets = append(facets, name)
+		}
+	}
+	return facets, nil
+}
+
+// countFacets räknar produkterna per värde i varje facett. filterQuery och args är
+// frågan med id:n för produkterna som matchar filtren och dess parametrar.
+func countFacets(db *sql.DB, facets []string, filterQuery string, args []interface{}) (map[string][]FacetCount, error) {
+	counts := make(map[string][]FacetCount, len(facets))
+	for _, name := range facets {
+		rows, err := db.Query(fmt.Sprintf(productFacets[name], filterQuery), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		values := []FacetCount{}
+		for rows.Next() {
+			var f FacetCount
+			if err := rows.Scan(&f.Value, &f.Label, &f.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			values = append(values, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		counts[name] = values
+	}
+	return counts, nil
+}
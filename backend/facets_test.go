@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFacets(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"category", []string{"category"}, false},
+		{"category,brand", []string{"category", "brand"}, false},
+		{" importer , is_universal ", []string{"importer", "is_universal"}, false},
+		{"brand,category,brand", []string{"brand", "category"}, false},
+		{"price", nil, true},
+		{"category,", nil, true},
+		{"Category", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFacets(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFacets(%q): fel = %v, vill ha fel: %t", tt.v, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFacets(%q) = %q, vill ha %q", tt.v, got, tt.want)
+		}
+	}
+}
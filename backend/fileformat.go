@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Filtyper som kan importeras
+const (
+	fileTypeCSV  = "csv"
+	fileTypeXLSX = "xlsx"
+	fileTypeODS  = "ods"
+)
+
+// fileTypeOf känner igen filtypen på filändelsen
+func fileTypeOf(filename string) (string, bool) {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv":
+		return fileTypeCSV, true
+	case ".xlsx":
+		return fileTypeXLSX, true
+	case ".ods":
+		return fileTypeODS, true
+	}
+	return "", false
+}
+
+// autoDetect som teckenkodning eller avgränsare betyder att den hittas automatiskt i filen
+const autoDetect = "auto"
+
+// Så mycket av filens början som används för att känna igen kodning och avgränsare
+const sniffSize = 64 << 10
+
+// Antal rader som jämförs när avgränsaren letas upp
+const sniffLines = 20
+
+// Avgränsare som kan hittas automatiskt, i den ordning de föredras vid lika
+var delimiterCandidates = []rune{';', ',', '\t'}
+
+// Standardavgränsaren om ingen kandidat förekommer i filen
+const fallbackDelimiter = ';'
+
+func isAutoDetect(s string) bool {
+	return strings.EqualFold(strings.TrimSpace(s), autoDetect)
+}
+
+// lookupEncoding slår upp en teckenkodning, t.ex. "windows-1252" eller "utf-8".
+// UTF-8 och UTF-16 läses så att en inledande BOM tas bort.
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "utf-8", "utf8":
+		return unicode.UTF8BOM, nil
+	case "utf-16", "utf-16le":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case "utf-16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("okänd teckenkodning %q", name)
+	}
+	return enc, nil
+}
+
+// parseDelimiter översätter en avgränsare till en rune. "tab" och "\t" betyder tabb.
+func parseDelimiter(s string) (rune, error) {
+	switch s {
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, fmt.Errorf("avgränsaren måste vara exakt ett tecken, fick %q", s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("ogiltig avgränsare %q", s)
+	}
+	return r, nil
+}
+
+// detectFormat bestämmer filens teckenkodning och avgränsare utifrån början av filen.
+// Värden som är satta i profilen används som de är, förutom att en BOM alltid vinner
+// eftersom den entydigt anger kodningen.
+func detectFormat(sample []byte, profile ImportProfile) (FileFormat, error) {
+	format := FileFormat{Encoding: profile.Encoding, Delimiter: profile.Delimiter}
+
+	if bom := bomEncoding(sample); bom != "" {
+		format.EncodingDetected = !strings.EqualFold(format.Encoding, bom)
+		format.Encoding = bom
+	} else if isAutoDetect(format.Encoding) {
+		format.Encoding = detectEncoding(sample)
+		format.EncodingDetected = true
+	}
+
+	enc, err := lookupEncoding(format.Encoding)
+	if err != nil {
+		return format, err
+	}
+
+	if isAutoDetect(format.Delimiter) {
+		format.Delimiter = string(fallbackDelimiter)
+		if text, err := decodeSample(sample, enc, format.Encoding); err == nil {
+			format.Delimiter = string(detectDelimiter(text))
+		}
+		format.DelimiterDetected = true
+	}
+
+	comma, err := parseDelimiter(format.Delimiter)
+	if err != nil {
+		return format, err
+	}
+	format.Delimiter = string(comma)
+	return format, nil
+}
+
+// bomEncoding returnerar kodningen som filens BOM anger, eller "" om BOM saknas
+func bomEncoding(sample []byte) string {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	}
+	return ""
+}
+
+// detectEncoding gissar kodningen för en fil utan BOM. UTF-16 känns igen på nollbytes
+// i varannan position, giltig UTF-8 antas vara UTF-8 och allt annat läses som
+// Windows-1252 (som täcker ISO-8859-1).
+func detectEncoding(sample []byte) string {
+	var evenZeros, oddZeros int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	pairs := len(sample) / 2
+	if pairs > 0 {
+		switch {
+		case oddZeros > pairs/4 && evenZeros < oddZeros/8:
+			return "utf-16le"
+		case evenZeros > pairs/4 && oddZeros < evenZeros/8:
+			return "utf-16be"
+		}
+	}
+
+	// Provet kan sluta mitt i ett flerbytestecken
+	if len(sample) == sniffSize {
+		for i := 0; i < utf8.UTFMax-1 && len(sample) > 0 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+	if utf8.Valid(sample) {
+		return "utf-8"
+	}
+	return "windows-1252"
+}
+
+func decodeSample(sample []byte, enc encoding.Encoding, name string) (string, error) {
+	if strings.HasPrefix(strings.ToLower(name), "utf-16") && len(sample)%2 != 0 {
+		sample = sample[:len(sample)-1]
+	}
+	text, err := enc.NewDecoder().Bytes(sample)
+	return string(text), err
+}
+
+// detectDelimiter väljer den kandidat som förekommer lika många gånger på flest rader
+// som i headern. Vid lika vinner den som förekommer flest gånger i headern.
+func detectDelimiter(text string) rune {
+	var lines []map[rune]int
+	current := map[rune]int{}
+	inQuote := false
+
+	for _, r := range text {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case r == '\n':
+			lines = append(lines, current)
+			current = map[rune]int{}
+		default:
+			current[r]++
+		}
+		if len(lines) == sniffLines {
+			break
+		}
+	}
+	// Den sista raden i provet räknas bara om den är hela filen
+	if len(lines) == 0 {
+		lines = append(lines, current)
+	}
+
+	best, bestMatches, bestCount := rune(fallbackDelimiter), 0, 0
+	for _, c := range delimiterCandidates {
+		count := lines[0][c]
+		if count == 0 {
+			continue
+		}
+
+		matches := 0
+		for _, line := range lines {
+			if line[c] == count {
+				matches++
+			}
+		}
+		if matches > bestMatches || (matches == bestMatches && count > bestCount) {
+			best, bestMatches, bestCount = c, matches, count
+		}
+	}
+	return best
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"unicode/utf16"
+)
+
+// utf16Bytes kodar s som UTF-16 utan BOM
+func utf16Bytes(s string, bigEndian bool) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+const formatSample = "Kategori;Märke;Modell;År\nFjädrar;KTM;SX-F 450;2019-2022\nDämpare;Husqvarna;FC 450;2020+\n"
+
+func TestDetectEncoding(t *testing.T) {
+	// "Märke" med ä som en byte i windows-1252
+	latin1 := []byte("Kategori;M\xe4rke\nFj\xe4drar;KTM\n")
+
+	// Ett prov som är avklippt mitt i ett flerbytestecken är fortfarande UTF-8
+	cut := bytes.Repeat([]byte("a"), sniffSize-1)
+	cut = append(cut, "ä"[0])
+
+	tests := []struct {
+		name   string
+		sample []byte
+		want   string
+	}{
+		{"ascii", []byte("Kategori;Modell\n"), "utf-8"},
+		{"utf-8", []byte(formatSample), "utf-8"},
+		{"windows-1252", latin1, "windows-1252"},
+		{"utf-16le", utf16Bytes(formatSample, false), "utf-16le"},
+		{"utf-16be", utf16Bytes(formatSample, true), "utf-16be"},
+		{"avklippt utf-8", cut, "utf-8"},
+		{"tomt", nil, "utf-8"},
+	}
+	for _, tt := range tests {
+		if got := detectEncoding(tt.sample); got != tt.want {
+			t.Errorf("%s: detectEncoding = %q, vill ha %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDelimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want rune
+	}{
+		{"semikolon", formatSample, ';'},
+		{"komma", "a,b,c\n1,2,3\n4,5,6\n", ','},
+		{"tabb", "a\tb\tc\n1\t2\t3\n", '\t'},
+		// Kommatecknen i namnen varierar mellan raderna, semikolonen gör det inte
+		{"komma i värden", "a;b\nFjäder, bak;1\nDämpare, fram, lång;2\n", ';'},
+		// Avgränsare inom citattecken räknas inte
+		{"citerade värden", "a,b\n\"1;2;3\",4\n\"5;6\",7\n", ','},
+		{"en rad utan radslut", "a,b,c", ','},
+		{"ingen kandidat", "kategori\nfjädrar\n", fallbackDelimiter},
+		{"tomt", "", fallbackDelimiter},
+	}
+	for _, tt := range tests {
+		if got := detectDelimiter(tt.text); got != tt.want {
+			t.Errorf("%s: detectDelimiter = %q, vill ha %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	bom := append([]byte{0xEF, 0xBB, 0xBF}, "a,b\n1,2\n"...)
+	utf16BOM := append([]byte{0xFF, 0xFE}, utf16Bytes("a\tb\n1\t2\n", false)...)
+
+	tests := []struct {
+		name            string
+		sample          []byte
+		encoding, delim string
+		want            FileFormat
+		wantErr         bool
+	}{
+		{"allt automatiskt", []byte(formatSample), "auto", "auto",
+			FileFormat{Encoding: "utf-8", Delimiter: ";", EncodingDetected: true, DelimiterDetected: true}, false},
+		{"profilens värden", []byte("a,b\n1,2\n"), "windows-1252", ";",
+			FileFormat{Encoding: "windows-1252", Delimiter: ";"}, false},
+		{"tabb i profilen", []byte("a\tb\n"), "utf-8", "tab",
+			FileFormat{Encoding: "utf-8", Delimiter: "\t"}, false},
+		{"BOM vinner över profilen", bom, "windows-1252", "auto",
+			FileFormat{Encoding: "utf-8", Delimiter: ",", EncodingDetected: true, DelimiterDetected: true}, false},
+		{"BOM som stämmer med profilen", bom, "utf-8", ",",
+			FileFormat{Encoding: "utf-8", Delimiter: ","}, false},
+		{"utf-16 med BOM", utf16BOM, "auto", "auto",
+			FileFormat{Encoding: "utf-16le", Delimiter: "\t", EncodingDetected: true, DelimiterDetected: true}, false},
+		{"okänd kodning", []byte("a;b\n"), "klingon", ";", FileFormat{}, true},
+		{"för lång avgränsare", []byte("a;b\n"), "utf-8", ";;", FileFormat{}, true},
+	}
+	for _, tt := range tests {
+		got, err := detectFormat(tt.sample, ImportProfile{Encoding: tt.encoding, Delimiter: tt.delim})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: fel = %v, vill ha fel: %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: detectFormat = %+v, vill ha %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// fitmentInput pekar ut motorcyklar antingen med id eller med märke, modell och
+// årsmodeller. years tolkas som i importen, så "2019-2021, 2023" ger två motorcyklar.
+type fitmentInput struct {
+	MotorcycleID int    `json:"motorcycle_id"`
+	Brand        string `json:"brand"`
+	Model        string `json:"model"`
+	Years        string `json:"years"`
+}
+
+// fitmentError är ett fel i en fitmentInput och ger 400
+type fitmentError struct {
+	msg string
+}
+
+func (e *fitmentError) Error() string {
+	return e.msg
+}
+
+// resolveFitment returnerar id:n för motorcyklarna som in pekar ut. Märket och modellen
+// måste finnas (alias och normaliserade namn matchar som vid import). Med create skapas
+// motorcyklar för årsmodeller som saknas; annars hoppas de över och years kan utelämnas
+// för att peka ut alla årsmodeller av modellen.
+func resolveFitment(q queryer, in fitmentInput, create bool) ([]int, error) {
+	if in.MotorcycleID != 0 {
+		if in.Brand != "" || in.Model != "" || in.Years != "" {
+			return nil, &fitmentError{"give either motorcycle_id or brand, model and years"}
+		}
+		var exists bool
+		if err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM motorcycles WHERE id = $1)`, in.MotorcycleID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, &fitmentError{fmt.Sprintf("motorcycle %d does not exist", in.MotorcycleID)}
+		}
+		return []int{in.MotorcycleID}, nil
+	}
+
+	if strings.TrimSpace(in.Brand) == "" || strings.TrimSpace(in.Model) == "" {
+		return nil, &fitmentError{"motorcycle_id or brand and model is required"}
+	}
+	brandID, brandName, err := findBrand(q, in.Brand)
+	if err == sql.ErrNoRows {
+		return nil, &fitmentError{fmt.Sprintf("unknown brand %q", in.Brand)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	modelID, modelName, err := findModel(q, brandID, in.Model)
+	if err == sql.ErrNoRows {
+		return nil, &fitmentError{fmt.Sprintf("unknown model %q for %s", in.Model, brandName)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(in.Years) == "" {
+		if create {
+			return nil, &fitmentError{"years is required"}
+		}
+		return modelMotorcycles(q, modelID)
+	}
+	years, err := parseModelYears(in.Years)
+	if err != nil {
+		return nil, &fitmentError{err.Error()}
+	}
+
+	var ids []int
+	for _, y := range years {
+		var id int
+		if create {
+			id, _, err = getOrCreateMotorcycle(q, brandID, modelID, y.StartYear, y.EndYear, motorcycleName(brandName, modelName, y))
+		} else {
+			err = q.QueryRow(`
+				SELECT id FROM motorcycles
+				WHERE brand_id = $1 AND model_id = $2 AND startyear = $3 AND endyear = $4
+			`, brandID, modelID, y.StartYear, y.EndYear).Scan(&id)
+			if err == sql.ErrNoRows {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// modelMotorcycles returnerar alla motorcyklar (årsmodeller) av en modell
+func modelMotorcycles(q queryer, modelID int) ([]int, error) {
+	rows, err := q.Query(`SELECT id FROM motorcycles WHERE model_id = $1`, modelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// productFitments returnerar motorcyklarna som produkten passar sorterade på märke,
+// modell och årsmodell. limit < 0 ger alla.
+func productFitments(q queryer, productID string, limit, offset int) ([]Motorcycle, error) {
+	var maxRows any // NULL ger LIMIT ALL
+	if limit >= 0 {
+		maxRows = limit
+	}
+	rows, err := q.Query(`
+		SELECT m.id, b.name, mo.name, m.startyear, m.endyear
+		FROM product_compatibility pc
+		JOIN motorcycles m ON pc.motorcycle_id = m.id
+		JOIN brands b ON m.brand_id = b.id
+		JOIN models mo ON m.model_id = mo.id
+		WHERE pc.product_id = $1
+		ORDER BY b.name, mo.name, m.startyear, m.endyear, m.id
+		LIMIT $2 OFFSET $3
+	`, productID, maxRows, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	motorcycles := []Motorcycle{}
+	for rows.Next() {
+		var m Motorcycle
+		if err := rows.Scan(&m.ID, &m.Brand, &m.Model, &m.StartYear, &m.EndYear); err != nil {
+			return nil, err
+		}
+		motorcycles = append(motorcycles, m)
+	}
+	return motorcycles, rows.Err()
+}
+
+// fitmentsForProducts hämtar motorcyklarna för flera produkter i en fråga, högst limit
+// per produkt i samma ordning som productFitments. limit < 0 ger alla.
+func fitmentsForProducts(q queryer, productIDs []string, limit int) (map[string][]Motorcycle, error) {
+	var maxRows any // NULL ger alla
+	if limit >= 0 {
+		maxRows = limit
+	}
+	rows, err := q.Query(`
+		SELECT product_id, id, brand, model, startyear, endyear
+		FROM (
+			SELECT pc.product_id, m.id, b.name AS brand, mo.name AS model, m.startyear, m.endyear,
+				ROW_NUMBER() OVER (
+					PARTITION BY pc.product_id
+					ORDER BY b.name, mo.name, m.startyear, m.endyear, m.id
+				) AS n
+			FROM product_compatibility pc
+			JOIN motorcycles m ON pc.motorcycle_id = m.id
+			JOIN brands b ON m.brand_id = b.id
+			JOIN models mo ON m.model_id = mo.id
+			WHERE pc.product_id = ANY($1)
+		) f
+		WHERE $2::int IS NULL OR n <= $2
+		ORDER BY product_id, n
+	`, pq.Array(productIDs), maxRows)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fitments := make(map[string][]Motorcycle, len(productIDs))
+	for rows.Next() {
+		var productID string
+		var m Motorcycle
+		if err := rows.Scan(&productID, &m.ID, &m.Brand, &m.Model, &m.StartYear, &m.EndYear); err != nil {
+			return nil, err
+		}
+		fitments[productID] = append(fitments[productID], m)
+	}
+	return fitments, rows.Err()
+}
+
+// fitmentChange ändrar produktens kopplingar inom tx och returnerar hur många som
+// lades till och togs bort
+type fitmentChange func(tx *sql.Tx, productID string) (added, removed int, err error)
+
+// changeFitments kör change i en transaktion med produkten låst och svarar med
+// produktens kopplingar efteråt. Ändrades något sätts produktens edited_at.
+func changeFitments(w http.ResponseWriter, db *sql.DB, productID string, status int, change fitmentChange) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT 1 FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database query error: %v", err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+
+	result := FitmentResult{ProductID: productID}
+	result.Added, result.Removed, err = change(tx, productID)
+	var invalid *fitmentError
+	if errors.As(err, &invalid) {
+		http.Error(w, "Invalid fitment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error changing fitments of product %s: %v", productID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if result.Added+result.Removed > 0 {
+		if _, err := tx.Exec(`UPDATE products SET edited_at = now() WHERE id = $1`, productID); err != nil {
+			log.Printf("Error marking product %s as edited: %v", productID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result.Motorcycles, err = productFitments(tx, productID, -1, 0)
+	if err != nil {
+		log.Printf("Database query error: %v", err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing fitments of product %s: %v", productID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// addFitments kopplar produkten till motorcyklarna som inte redan är kopplade
+func addFitments(tx *sql.Tx, productID string, motorcycleIDs []int) (int, error) {
+	added := 0
+	for _, id := range motorcycleIDs {
+		ok, err := insertProductCompatibility(tx, productID, id)
+		if err != nil {
+			return added, err
+		}
+		if ok {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func getFitmentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)`, id).Scan(&exists); err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+
+		motorcycles, err := productFitments(db, id, -1, 0)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(motorcycles)
+	}
+}
+
+// getProductMotorcyclesHandler listar motorcyklarna som produkten passar, sida för sida,
+// med det totala antalet i total som i /products.
+func getProductMotorcyclesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		limit, offset, err := parsePaging(r, 50, 500)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var page MotorcyclePage
+		err = db.QueryRow(`
+			SELECT (SELECT COUNT(*) FROM product_compatibility WHERE product_id = p.id)
+			FROM products p
+			WHERE p.id = $1
+		`, id).Scan(&page.Total)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		page.Items, err = productFitments(db, id, limit, offset)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// addFitmentHandler kopplar produkten till en motorcykel, eller till en modells
+// årsmodeller. Motorcyklar för nya årsintervall skapas.
+func addFitmentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in fitmentInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		changeFitments(w, db, mux.Vars(r)["id"], http.StatusCreated, func(tx *sql.Tx, productID string) (int, int, error) {
+			ids, err := resolveFitment(tx, in, true)
+			if err != nil {
+				return 0, 0, err
+			}
+			added, err := addFitments(tx, productID, ids)
+			return added, 0, err
+		})
+	}
+}
+
+// deleteFitmentHandler tar bort kopplingen till en motorcykel
+func deleteFitmentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		motorcycleID, err := strconv.Atoi(vars["motorcycle"])
+		if err != nil {
+			http.Error(w, "Invalid motorcycle id", http.StatusBadRequest)
+			return
+		}
+
+		// Produkten markeras som ändrad i samma sats som kopplingen tas bort
+		res, err := db.Exec(`
+			WITH deleted AS (
+				DELETE FROM product_compatibility WHERE product_id = $1 AND motorcycle_id = $2
+				RETURNING product_id
+			)
+			UPDATE products SET edited_at = now() WHERE id IN (SELECT product_id FROM deleted)
+		`, vars["id"], motorcycleID)
+		if err != nil {
+			log.Printf("Error deleting fitment: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Fitment not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteFitmentsHandler tar bort kopplingarna till en modell, angiven med brand, model
+// och valfritt years i URL:en. Utan years tas alla årsmodeller bort.
+func deleteFitmentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		in := fitmentInput{
+			Brand: query.Get("brand"),
+			Model: query.Get("model"),
+			Years: query.Get("years"),
+		}
+
+		changeFitments(w, db, mux.Vars(r)["id"], http.StatusOK, func(tx *sql.Tx, productID string) (int, int, error) {
+			ids, err := resolveFitment(tx, in, false)
+			if err != nil {
+				return 0, 0, err
+			}
+			motorcycleIDs := make([]int64, len(ids))
+			for i, id := range ids {
+				motorcycleIDs[i] = int64(id)
+			}
+			res, err := tx.Exec(`
+				DELETE FROM product_compatibility
+				WHERE product_id = $1 AND motorcycle_id = ANY($2)
+			`, productID, pq.Array(motorcycleIDs))
+			if err != nil {
+				return 0, 0, err
+			}
+			removed, err := res.RowsAffected()
+			return 0, int(removed), err
+		})
+	}
+}
+
+// replaceFitmentsHandler ersätter produktens alla kopplingar med listan i bodyn.
+// En tom lista tar bort alla kopplingar.
+func replaceFitmentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var inputs []fitmentInput
+		if err := json.NewDecoder(r.Body).Decode(&inputs); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		changeFitments(w, db, mux.Vars(r)["id"], http.StatusOK, func(tx *sql.Tx, productID string) (int, int, error) {
+			var ids []int
+			for i, in := range inputs {
+				resolved, err := resolveFitment(tx, in, true)
+				var invalid *fitmentError
+				if errors.As(err, &invalid) {
+					return 0, 0, &fitmentError{fmt.Sprintf("fitment %d: %s", i+1, invalid.msg)}
+				}
+				if err != nil {
+					return 0, 0, err
+				}
+				ids = append(ids, resolved...)
+			}
+
+			keep := make([]int64, len(ids))
+			for i, id := range ids {
+				keep[i] = int64(id)
+			}
+			res, err := tx.Exec(`
+				DELETE FROM product_compatibility
+				WHERE product_id = $1 AND NOT motorcycle_id = ANY($2)
+			`, productID, pq.Array(keep))
+			if err != nil {
+				return 0, 0, err
+			}
+			removed, err := res.RowsAffected()
+			if err != nil {
+				return 0, 0, err
+			}
+
+			added, err := addFitments(tx, productID, ids)
+			return added, int(removed), err
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// importFitmentProducts importerar products produkter med bikes motorcyklar var och
+// returnerar produkternas id:n
+func importFitmentProducts(tb testing.TB, products, bikes int) (*sql.DB, []string) {
+	tb.Helper()
+
+	db := testDB(tb)
+	importTestFile(tb, db, testFile(generatedRows(products, bikes)), true, importOptions{})
+
+	rows, err := db.Query(`SELECT id FROM products ORDER BY id`)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			tb.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return db, ids
+}
+
+// fitmentsForProducts ska ge samma motorcyklar i samma ordning som en fråga per produkt
+func TestFitmentsForProducts(t *testing.T) {
+	db, ids := importFitmentProducts(t, 5, 8)
+
+	for _, limit := range []int{-1, 3} {
+		batched, err := fitmentsForProducts(db, ids, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			want, err := productFitments(db, id, limit, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(batched[id], want) {
+				t.Errorf("limit %d, %s: fick %+v, vill ha %+v", limit, id, batched[id], want)
+			}
+		}
+	}
+}
+
+// PUT med en tom lista tar bort alla kopplingar men inte motorcyklarna, och svaret
+// har en tom lista i stället för null
+func TestReplaceFitmentsEmptyList(t *testing.T) {
+	db, ids := importFitmentProducts(t, 1, 3)
+	id := ids[0]
+
+	rec := callHandler(replaceFitmentsHandler(db), http.MethodPut, "/products/"+id+"/fitments", `[]`, map[string]string{"id": id})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /products/%s/fitments: %d %s", id, rec.Code, rec.Body)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if string(raw["motorcycles"]) != "[]" {
+		t.Errorf("motorcycles = %s, vill ha []", raw["motorcycles"])
+	}
+	var result FitmentResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 0 || result.Removed != 3 {
+		t.Errorf("added = %d, removed = %d, vill ha 0 och 3", result.Added, result.Removed)
+	}
+
+	var fitments, motorcycles int
+	var edited bool
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM product_compatibility WHERE product_id = $1),
+			(SELECT COUNT(*) FROM motorcycles),
+			(SELECT edited_at IS NOT NULL FROM products WHERE id = $1)
+	`, id).Scan(&fitments, &motorcycles, &edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fitments != 0 || motorcycles != 3 || !edited {
+		t.Errorf("kopplingar = %d, motorcyklar = %d, edited_at satt = %t; vill ha 0, 3, true", fitments, motorcycles, edited)
+	}
+
+	// En andra tom lista ändrar ingenting
+	rec = callHandler(replaceFitmentsHandler(db), http.MethodPut, "/products/"+id+"/fitments", `[]`, map[string]string{"id": id})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /products/%s/fitments igen: %d %s", id, rec.Code, rec.Body)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 0 || result.Removed != 0 {
+		t.Errorf("igen: added = %d, removed = %d, vill ha 0 och 0", result.Added, result.Removed)
+	}
+}
+
+// /products/{id}/motorcycles ger en sida av motorcyklarna och det totala antalet
+func TestProductMotorcyclesPage(t *testing.T) {
+	db, ids := importFitmentProducts(t, 1, 5)
+	id := ids[0]
+
+	rec := callHandler(getProductMotorcyclesHandler(db), http.MethodGet, "/products/"+id+"/motorcycles?limit=2&offset=4", "", map[string]string{"id": id})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /products/%s/motorcycles: %d %s", id, rec.Code, rec.Body)
+	}
+	var page MotorcyclePage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	want, err := productFitments(db, id, -1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 5 || !reflect.DeepEqual(page.Items, want) {
+		t.Errorf("fick %+v, vill ha total 5 och %+v", page, want)
+	}
+
+	rec = callHandler(getProductMotorcyclesHandler(db), http.MethodGet, "/products/saknas/motorcycles", "", map[string]string{"id": "saknas"})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /products/saknas/motorcycles: %d, vill ha 404", rec.Code)
+	}
+}
+
+// BenchmarkFitments jämför motorcyklarna för en sida med 50 produkter hämtade med en
+// fråga per produkt (som /products gjorde tidigare) och med en fråga för hela sidan
+func BenchmarkFitments(b *testing.B) {
+	db, ids := importFitmentProducts(b, 50, 20)
+
+	b.Run("per_product", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, id := range ids {
+				if _, err := productFitments(db, id, 10, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := fitmentsForProducts(db, ids, 10); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Hur märken och modeller som liknar ett befintligt namn hanteras
+const (
+	unknownNamesCreate = "create" // skapas som nya, förslaget visas bara
+	unknownNamesMap    = "map"    // mappas till det befintliga namnet
+	unknownNamesReview = "review" // raden hålls för granskning och importeras inte
+)
+
+// Standardtröskeln för när ett okänt namn anses vara en felstavning av ett befintligt
+const defaultMatchThreshold = 0.85
+
+// Förslag under den här likheten visas inte alls
+const minSuggestionSimilarity = 0.6
+
+// Vad som hände med ett okänt namn
+const (
+	suggestionCreated = "created"
+	suggestionMapped  = "mapped"
+	suggestionHeld    = "held"
+)
+
+// nameCandidate är ett befintligt namn eller alias som ett okänt namn jämförs med
+type nameCandidate struct {
+	normalized string
+	name       string // det kanoniska namnet som föreslås
+}
+
+// nameKey identifierar ett okänt namn. brand är märkets normaliserade namn för modeller.
+type nameKey struct {
+	kind  string
+	brand string
+	name  string
+}
+
+// nameDecision är vad som bestämdes för ett okänt namn första gången det förekom
+type nameDecision struct {
+	best   nameCandidate
+	action string
+}
+
+// nameMatcher jämför märken och modeller som saknas i databasen med de som finns och
+// föreslår närmaste namn. Allt läses in innan importen börjar så att den också kan
+// användas medan bulk-importens COPY pågår. Bara namn som fanns före importen föreslås,
+// så att resultatet inte beror på i vilken ordning raderna kommer.
+type nameMatcher struct {
+	policy    string
+	threshold float64
+
+	// brands slår upp normaliserade namn och alias till märkets kanoniska namn
+	brands          map[string]string
+	brandCandidates []nameCandidate
+	// models och modelCandidates nycklas på märkets normaliserade kanoniska namn
+	models          map[string]map[string]string
+	modelCandidates map[string][]nameCandidate
+
+	decisions   map[nameKey]nameDecision
+	suggestions map[nameKey]*NameSuggestion
+	order       []nameKey
+}
+
+func newNameMatcher(q queryer, policy string, threshold float64) (*nameMatcher, error) {
+	if policy == "" {
+		policy = unknownNamesCreate
+	}
+	if threshold == 0 {
+		threshold = defaultMatchThreshold
+	}
+	m := &nameMatcher{
+		policy:          policy,
+		threshold:       threshold,
+		brands:          make(map[string]string),
+		models:          make(map[string]map[string]string),
+		modelCandidates: make(map[string][]nameCandidate),
+		decisions:       make(map[nameKey]nameDecision),
+		suggestions:     make(map[nameKey]*NameSuggestion),
+	}
+
+	rows, err := q.Query(`
+		SELECT normalized_name, name FROM brands WHERE normalized_name IS NOT NULL
+		UNION ALL
+		SELECT a.normalized, b.name FROM brand_aliases a JOIN brands b ON b.id = a.brand_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte läsa märken: %w", err)
+	}
+	for rows.Next() {
+		var c nameCandidate
+		if err := rows.Scan(&c.normalized, &c.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := m.brands[c.normalized]; !ok {
+			m.brands[c.normalized] = c.name
+			m.brandCandidates = append(m.brandCandidates, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+		SELECT b.name, mo.normalized_name, mo.name
+		FROM models mo JOIN brands b ON b.id = mo.brand_id
+		WHERE mo.normalized_name IS NOT NULL
+		UNION ALL
+		SELECT b.name, a.normalized, mo.name
+		FROM model_aliases a JOIN models mo ON mo.id = a.model_id JOIN brands b ON b.id = a.brand_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte läsa modeller: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var brand string
+		var c nameCandidate
+		if err := rows.Scan(&brand, &c.normalized, &c.name); err != nil {
+			return nil, err
+		}
+		brandKey := normalizeName(brand)
+		known := m.models[brandKey]
+		if known == nil {
+			known = make(map[string]string)
+			m.models[brandKey] = known
+		}
+		if _, ok := known[c.normalized]; !ok {
+			known[c.normalized] = c.name
+			m.modelCandidates[brandKey] = append(m.modelCandidates[brandKey], c)
+		}
+	}
+	return m, rows.Err()
+}
+
+// resolve kontrollerar radens märke och modell. Ett namn som liknar ett befintligt
+// byts mot det befintliga vid unknown_names=map; vid review returneras varför raden
+// hålls. Namn som inte liknar något skapas som vanligt.
+func (m *nameMatcher) resolve(r *csvRow) (mapped []string, held string) {
+	if r.isUniversal {
+		return nil, ""
+	}
+
+	brandKey := normalizeName(r.brand)
+	if canonical, ok := m.brands[brandKey]; ok {
+		// Modellerna nycklas på det kanoniska namnet, inte på aliaset
+		brandKey = normalizeName(canonical)
+	} else {
+		best, action := m.decide(nameKey{kind: "brand", name: brandKey}, r.brand, "", m.brandCandidates, r.num)
+		switch action {
+		case suggestionMapped:
+			mapped = append(mapped, "brand: "+r.brand+" → "+best.name)
+			r.brand = best.name
+			brandKey = normalizeName(best.name)
+		case suggestionHeld:
+			return nil, fmt.Sprintf("okänt märke %q, menade du %q?", r.brand, best.name)
+		}
+	}
+
+	modelKey := normalizeName(r.model)
+	if _, ok := m.models[brandKey][modelKey]; !ok {
+		best, action := m.decide(nameKey{kind: "model", brand: brandKey, name: modelKey}, r.model, r.brand, m.modelCandidates[brandKey], r.num)
+		switch action {
+		case suggestionMapped:
+			mapped = append(mapped, "model: "+r.model+" → "+best.name)
+			r.model = best.name
+		case suggestionHeld:
+			return nil, fmt.Sprintf("okänd modell %q för %s, menade du %q?", r.model, r.brand, best.name)
+		}
+	}
+	return mapped, ""
+}
+
+// decide bestämmer vad som händer med ett okänt namn första gången det förekommer och
+// samlar förslaget. Senare rader med samma namn får samma beslut.
+func (m *nameMatcher) decide(key nameKey, name, brand string, candidates []nameCandidate, row int) (nameCandidate, string) {
+	if d, ok := m.decisions[key]; ok {
+		if s := m.suggestions[key]; s != nil {
+			s.Rows++
+		}
+		return d.best, d.action
+	}
+
+	best, similarity := closestName(candidates, key.name)
+	action := suggestionCreated
+	if similarity >= m.threshold {
+		switch m.policy {
+		case unknownNamesMap:
+			action = suggestionMapped
+		case unknownNamesReview:
+			action = suggestionHeld
+		}
+	}
+	m.decisions[key] = nameDecision{best: best, action: action}
+
+	if similarity >= minSuggestionSimilarity {
+		m.suggestions[key] = &NameSuggestion{
+			Kind:       key.kind,
+			Brand:      brand,
+			Name:       name,
+			Suggestion: best.name,
+			Similarity: math.Round(similarity*100) / 100,
+			Action:     action,
+			Rows:       1,
+			FirstRow:   row,
+		}
+		m.order = append(m.order, key)
+	}
+	return best, action
+}
+
+// report returnerar förslagen i den ordning namnen först förekom i filen
+func (m *nameMatcher) report() []NameSuggestion {
+	suggestions := make([]NameSuggestion, len(m.order))
+	for i, key := range m.order {
+		suggestions[i] = *m.suggestions[key]
+	}
+	return suggestions
+}
+
+// closestName hittar kandidaten med högst likhet
+func closestName(candidates []nameCandidate, normalized string) (nameCandidate, float64) {
+	var best nameCandidate
+	bestSimilarity := 0.0
+	for _, c := range candidates {
+		if s := similarity(c.normalized, normalized); s > bestSimilarity {
+			best, bestSimilarity = c, s
+		}
+	}
+	return best, bestSimilarity
+}
+
+// similarity är 1 minus redigeringsavståndet delat med det längsta namnets längd,
+// så 1 är identiska namn och 0 helt olika
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := max(len(ra), len(rb))
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(longest)
+}
+
+// editDistance är Levenshtein-avståndet där två bokstäver som bytt plats räknas som en
+// ändring (optimal string alignment), eftersom det är en vanlig felskrivning
+func editDistance(a, b []rune) int {
+	prevPrev := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				curr[j] = min(curr[j], prevPrev[j-2]+1)
+			}
+		}
+		prevPrev, prev, curr = prev, curr, prevPrev
+	}
+	return prev[len(b)]
+}
+
+// parseMatchThreshold tolkar match_threshold, ett tal mellan 0 och 1
+func parseMatchThreshold(s string) (float64, error) {
+	if s == "" {
+		return defaultMatchThreshold, nil
+	}
+	t, err := strconv.ParseFloat(s, 64)
+	if err != nil || t <= 0 || t > 1 {
+		return 0, fmt.Errorf("match_threshold måste vara ett tal mellan 0 och 1, fick %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"ktm", "", 3},
+		{"", "ktm", 3},
+		{"ktm", "ktm", 0},
+		{"husqvarna", "husqvarma", 1}, // utbytt bokstav
+		{"husqvarna", "husqvara", 1},  // borttagen bokstav
+		{"yamaha", "yamahaa", 1},      // tillagd bokstav
+		{"honda", "hodna", 1},         // två bokstäver som bytt plats
+		{"kawasaki", "kawaski", 1},
+		{"beta", "gasgas", 5},
+		{"åäö", "aao", 3}, // runor, inte byte
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, vill ha %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, vill ha %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want float64
+	}{
+		{"", "", 1},
+		{"ktm", "ktm", 1},
+		{"ktm", "", 0},
+		{"husqvarna", "husqvarma", 1 - 1.0/9},
+		{"honda", "hodna", 0.8},
+		{"125 sx", "125 xs", 1 - 1.0/6},
+		{"abc", "xyz", 0},
+	}
+	for _, tt := range tests {
+		if got := similarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("similarity(%q, %q) = %v, vill ha %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClosestName(t *testing.T) {
+	candidates := []nameCandidate{
+		{normalized: "husqvarna", name: "Husqvarna"},
+		{normalized: "honda", name: "Honda"},
+		{normalized: "ktm", name: "KTM"},
+		{normalized: "kxm", name: "KXM"},
+	}
+	tests := []struct {
+		normalized     string
+		want           string
+		wantSimilarity float64
+	}{
+		{"husqvarma", "Husqvarna", 1 - 1.0/9},
+		{"hodna", "Honda", 0.8},
+		{"ktm", "KTM", 1},
+		// Lika lika kandidater ger den första
+		{"kum", "KTM", 1 - 1.0/3},
+		{"zzzzzzzz", "", 0},
+	}
+	for _, tt := range tests {
+		got, s := closestName(candidates, tt.normalized)
+		if got.name != tt.want || math.Abs(s-tt.wantSimilarity) > 1e-9 {
+			t.Errorf("closestName(%q) = %q, %v, vill ha %q, %v", tt.normalized, got.name, s, tt.want, tt.wantSimilarity)
+		}
+	}
+
+	if got, s := closestName(nil, "ktm"); got != (nameCandidate{}) || s != 0 {
+		t.Errorf("closestName utan kandidater = %+v, %v, vill ha inget", got, s)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Utfall per rad i import_rows
+const (
+	rowCreated = "created"
+	rowUpdated = "updated"
+	rowSkipped = "skipped"
+	rowFailed  = "failed"
+	// Raden hölls för granskning eftersom märket eller modellen liknade ett befintligt namn
+	rowHeld = "held"
+)
+
+// outcome sammanfattar vad raden gjorde med databasen
+func (r RowResult) outcome() string {
+	switch {
+	case r.Error != "":
+		return rowFailed
+	case r.Held != "":
+		return rowHeld
+	case len(r.Created) > 0:
+		return rowCreated
+	case r.Updated:
+		return rowUpdated
+	default:
+		return rowSkipped
+	}
+}
+
+func recordImportRow(q queryer, importID int, r RowResult) error {
+	var message string
+	if r.Error != "" {
+		message = r.Error
+	} else if r.Held != "" {
+		message = r.Held
+	} else if len(r.Created) > 0 || len(r.Mapped) > 0 {
+		parts := make([]string, 0, len(r.Created)+len(r.Mapped))
+		for _, c := range r.Created {
+			parts = append(parts, c.Kind+": "+c.Name)
+		}
+		for _, m := range r.Mapped {
+			parts = append(parts, "mapped "+m)
+		}
+		message = strings.Join(parts, ", ")
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO import_rows (import_id, row_number, outcome, product_id, message)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (import_id, row_number) DO UPDATE
+		SET outcome = EXCLUDED.outcome, product_id = EXCLUDED.product_id, message = EXCLUDED.message
+	`, importID, r.Row, r.outcome(), r.ProductID, message)
+	return err
+}
+
+const importColumns = `
+	id, filename, COALESCE(uploader, ''), root_category, profile, method, mode,
+	unknown_names, match_threshold, file_type, sheet, encoding, delimiter, encoding_detected, delimiter_detected, state,
+	queued_at, started_at, finished_at, rolled_back_at,
+	bytes_total, bytes_processed,
+	rows_processed, rows_created, rows_updated, rows_skipped, rows_failed, rows_held,
+	error, error_row
+`
+
+func scanImport(row interface{ Scan(...any) error }) (Import, error) {
+	var imp Import
+	var errMsg sql.NullString
+	var errRow sql.NullInt64
+
+	err := row.Scan(&imp.ID, &imp.Filename, &imp.Uploader, &imp.RootCategory, &imp.Profile, &imp.Method, &imp.Mode,
+		&imp.UnknownNames, &imp.MatchThreshold, &imp.Format.Type, &imp.Format.Sheet, &imp.Format.Encoding, &imp.Format.Delimiter, &imp.Format.EncodingDetected, &imp.Format.DelimiterDetected, &imp.State,
+		&imp.QueuedAt, &imp.StartedAt, &imp.FinishedAt, &imp.RolledBackAt,
+		&imp.BytesTotal, &imp.BytesProcessed,
+		&imp.RowsProcessed, &imp.RowsCreated, &imp.RowsUpdated, &imp.RowsSkipped, &imp.RowsFailed, &imp.RowsHeld,
+		&errMsg, &errRow)
+	if err != nil {
+		return imp, err
+	}
+
+	if errMsg.Valid {
+		imp.Error = &ImportFailure{Error: errMsg.String, Row: int(errRow.Int64)}
+	}
+	if imp.BytesTotal > 0 {
+		imp.ProgressPercent = float64(imp.BytesProcessed) * 100 / float64(imp.BytesTotal)
+	}
+	if imp.StartedAt != nil && imp.FinishedAt != nil {
+		duration := imp.FinishedAt.Sub(*imp.StartedAt)
+		imp.DurationMS = duration.Milliseconds()
+		if duration > 0 {
+			imp.RowsPerSecond = float64(imp.RowsProcessed) / duration.Seconds()
+		}
+	}
+	return imp, nil
+}
+
+func (t importTask) method() string {
+	if t.bulk {
+		return importMethodBulk
+	}
+	return importMethodRows
+}
+
+func (t importTask) mode() string {
+	if t.sync {
+		return importModeSync
+	}
+	return importModeUpsert
+}
+
+func createImport(db *sql.DB, task importTask) (Import, error) {
+	row := db.QueryRow(`
+		INSERT INTO imports (filename, uploader, root_category, profile, method, mode, unknown_names, match_threshold,
+			file_type, sheet, encoding, delimiter, encoding_detected, delimiter_detected, state, bytes_total)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING `+importColumns,
+		task.filename, task.uploader, task.rootCategory, task.profile.Name, task.method(), task.mode(),
+		task.unknownNames, task.matchThreshold, task.format.Type, task.format.Sheet, task.format.Encoding, task.format.Delimiter, task.format.EncodingDetected, task.format.DelimiterDetected,
+		jobQueued, task.size)
+	return scanImport(row)
+}
+
+func getImport(db *sql.DB, id int) (Import, error) {
+	return scanImport(db.QueryRow(`SELECT `+importColumns+` FROM imports WHERE id = $1`, id))
+}
+
+func markImportStarted(db *sql.DB, id int) error {
+	_, err := db.Exec(`UPDATE imports SET state = $1, started_at = now() WHERE id = $2`, jobRunning, id)
+	return err
+}
+
+func finishImport(db *sql.DB, id int, report *ImportReport) error {
+	_, err := db.Exec(`
+		UPDATE imports
+		SET state = $1, finished_at = now(), rows_processed = $2, bytes_processed = bytes_total,
+			rows_created = $3, rows_updated = $4, rows_skipped = $5, rows_failed = $6, rows_held = $7
+		WHERE id = $8
+	`, jobSucceeded, report.RowsTotal, report.RowsCreated, report.RowsUpdated, report.RowsSkipped, report.RowsFailed, report.RowsHeld, id)
+	return err
+}
+
+// failImport markerar importen som misslyckad. Importens rader rullades tillbaka med
+// transaktionen, så bara raden som stoppade importen loggas.
+func failImport(db *sql.DB, id int, importErr error) error {
+	failure := importFailure(importErr)
+
+	var rowErr *RowError
+	if errors.As(importErr, &rowErr) {
+		row := RowResult{Row: rowErr.Row, ProductID: rowErr.ProductID, Error: failure.Error}
+		if err := recordImportRow(db, id, row); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+		UPDATE imports
+		SET state = $1, finished_at = now(), rows_failed = $2, error = $3, error_row = NULLIF($4, 0)
+		WHERE id = $5
+	`, jobFailed, min(failure.Row, 1), failure.Error, failure.Row, id)
+	return err
+}
+
+// parsePaging läser limit och offset från query-parametrarna
+func parsePaging(r *http.Request, defaultLimit, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	var err error
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxLimit)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+func getImportsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePaging(r, 50, 500)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`SELECT `+importColumns+` FROM imports ORDER BY id DESC LIMIT $1 OFFSET $2`, limit, offset)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		imports := []Import{}
+		for rows.Next() {
+			imp, err := scanImport(rows)
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			imports = append(imports, imp)
+		}
+
+		json.NewEncoder(w).Encode(imports)
+	}
+}
+
+func getImportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid import id", http.StatusBadRequest)
+			return
+		}
+
+		imp, err := getImport(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(imp)
+	}
+}
+
+// getImportRowsHandler listar radutfallen för en import, valfritt filtrerat på outcome och product_id
+func getImportRowsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid import id", http.StatusBadRequest)
+			return
+		}
+
+		limit, offset, err := parsePaging(r, 500, 5000)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := getImport(db, id); err == sql.ErrNoRows {
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		whereClauses := []string{"import_id = $1"}
+		args := []interface{}{id}
+
+		if outcome := r.URL.Query().Get("outcome"); outcome != "" {
+			switch outcome {
+			case rowCreated, rowUpdated, rowSkipped, rowFailed, rowHeld:
+			default:
+				http.Error(w, "Invalid outcome", http.StatusBadRequest)
+				return
+			}
+			args = append(args, outcome)
+			whereClauses = append(whereClauses, fmt.Sprintf("outcome = $%d", len(args)))
+		}
+		if productID := r.URL.Query().Get("product_id"); productID != "" {
+			args = append(args, productID)
+			whereClauses = append(whereClauses, fmt.Sprintf("product_id = $%d", len(args)))
+		}
+
+		args = append(args, limit, offset)
+		query := fmt.Sprintf(`
+			SELECT row_number, outcome, COALESCE(product_id, ''), COALESCE(message, '')
+			FROM import_rows
+			WHERE %s
+			ORDER BY row_number
+			LIMIT $%d OFFSET $%d
+		`, strings.Join(whereClauses, " AND "), len(args)-1, len(args))
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		importRows := []ImportRow{}
+		for rows.Next() {
+			var ir ImportRow
+			if err := rows.Scan(&ir.Row, &ir.Outcome, &ir.ProductID, &ir.Message); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			importRows = append(importRows, ir)
+		}
+
+		json.NewEncoder(w).Encode(importRows)
+	}
+}
+
+// getImportDiffHandler visar vad en import lade till, ändrade och tog bort, byggt ur import_changes
+func getImportDiffHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid import id", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := getImport(db, id); err == sql.ErrNoRows {
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		changes, err := getImportChanges(db, id)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		// getImportChanges ger den senaste ändringen först
+		diff := newImportDiff()
+		for i := len(changes) - 1; i >= 0; i-- {
+			diff.add(changes[i])
+		}
+
+		json.NewEncoder(w).Encode(diff)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	// En lyckad import som har rullats tillbaka via /imports/{id}/rollback
+	jobRolledBack = "rolled_back"
+)
+
+// Hur ofta rows_processed och bytes_processed skrivs till imports-tabellen under en import
+const progressInterval = 250
+
+var errQueueFull = errors.New("import queue is full")
+
+// importTask är allt en worker behöver för att köra en import
+type importTask struct {
+	importID int
+	filename string
+	uploader string
+	// path är den uppladdade filen som sparats på disk. Den tas bort när importen är klar.
+	path   string
+	size   int64
+	format FileFormat
+	// sheet är arket som ska läsas i en arbetsbok, på namn eller nummer
+	sheet        string
+	rootCategory string
+	profile      ImportProfile
+	// bulk kör importen via COPY och staging-tabeller i stället för rad för rad
+	bulk bool
+	// sync gör katalogen lik filen, se syncCatalog
+	sync bool
+	// unknownNames och matchThreshold styr hur namn som liknar befintliga hanteras, se nameMatcher
+	unknownNames   string
+	matchThreshold float64
+}
+
+// countingReader räknar hur många bytes som har lästs, för att kunna visa förlopp.
+// För kalkylblad läses zip-arkivet med ReadAt, så båda räknas.
+type countingReader struct {
+	f *os.File
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.f.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.f.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+// open öppnar den uppladdade filen och läser headern. Raderna läses sedan en i taget
+// från källan så att hela filen aldrig behöver ligga i minnet.
+func (t importTask) open() (*os.File, *countingReader, *importSource, error) {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("kunde inte öppna filen: %w", err)
+	}
+
+	counter := &countingReader{f: file}
+
+	var src *importSource
+	switch t.format.Type {
+	case fileTypeXLSX:
+		src, err = xlsxreader(counter, t.size, t.sheet, t.profile)
+	case fileTypeODS:
+		src, err = odsreader(counter, t.size, t.sheet, t.profile)
+	default:
+		src, err = csvreader(counter, t.profile)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+	return file, counter, src, nil
+}
+
+// importQueue håller köade importer och en pool av workers som kör dem.
+// Jobbens status lagras i imports-tabellen.
+type importQueue struct {
+	db    *sql.DB
+	tasks chan importTask
+}
+
+func newImportQueue(db *sql.DB, workers int, size int) *importQueue {
+	// Jobb som var köade eller pågick när servern stoppades kan inte återupptas
+	_, err := db.Exec(`
+		UPDATE imports SET state = $1, error = 'interrupted by server restart', finished_at = now()
+		WHERE state IN ($2, $3)
+	`, jobFailed, jobQueued, jobRunning)
+	if err != nil {
+		log.Printf("Error marking interrupted imports: %v", err)
+	}
+
+	q := &importQueue{
+		db:    db,
+		tasks: make(chan importTask, size),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// enqueue registrerar importen i databasen och lägger den på kön utan att blockera
+func (q *importQueue) enqueue(task importTask) (Import, error) {
+	if len(q.tasks) == cap(q.tasks) {
+		return Import{}, errQueueFull
+	}
+
+	imp, err := createImport(q.db, task)
+	if err != nil {
+		return Import{}, err
+	}
+	task.importID = imp.ID
+
+	select {
+	case q.tasks <- task:
+	default:
+		if _, err := q.db.Exec(`DELETE FROM imports WHERE id = $1`, imp.ID); err != nil {
+			log.Printf("Error removing unqueued import %d: %v", imp.ID, err)
+		}
+		return Import{}, errQueueFull
+	}
+
+	return imp, nil
+}
+
+func (q *importQueue) worker() {
+	for task := range q.tasks {
+		q.run(task)
+	}
+}
+
+func (q *importQueue) run(task importTask) {
+	defer func() {
+		if err := os.Remove(task.path); err != nil {
+			log.Printf("Error removing upload %s: %v", task.path, err)
+		}
+	}()
+
+	if err := markImportStarted(q.db, task.importID); err != nil {
+		log.Printf("Error starting import %d: %v", task.importID, err)
+	}
+
+	report, err := q.runImport(task)
+	if err != nil {
+		log.Printf("Import %d failed: %v", task.importID, err)
+		if err := failImport(q.db, task.importID, err); err != nil {
+			log.Printf("Error recording failed import %d: %v", task.importID, err)
+		}
+		return
+	}
+
+	if err := finishImport(q.db, task.importID, report); err != nil {
+		log.Printf("Error recording finished import %d: %v", task.importID, err)
+	}
+}
+
+// runImport kör importen i en transaktion så att ett fel lämnar databasen orörd
+func (q *importQueue) runImport(task importTask) (*ImportReport, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	file, counter, src, err := task.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	defer src.Close()
+
+	lastProgress := time.Now()
+	opts := importOptions{
+		importID:       task.importID,
+		sync:           task.sync,
+		unknownNames:   task.unknownNames,
+		matchThreshold: task.matchThreshold,
+		progress: func(processed int) {
+			if processed%progressInterval != 0 && time.Since(lastProgress) < time.Second {
+				return
+			}
+			lastProgress = time.Now()
+			// Skrivs utanför transaktionen så att förloppet syns medan importen pågår
+			_, err := q.db.Exec(`UPDATE imports SET rows_processed = $1, bytes_processed = $2 WHERE id = $3`,
+				processed, counter.n, task.importID)
+			if err != nil {
+				log.Printf("Error updating progress for import %d: %v", task.importID, err)
+			}
+		},
+	}
+
+	var report *ImportReport
+	if task.bulk {
+		report, err = bulkInsertFromCSV(tx, src.rows, src.cols, task.rootCategory, task.profile, opts)
+	} else {
+		report, err = insertFromCSV(tx, src.rows, src.cols, task.rootCategory, task.profile, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("kunde inte spara importen: %w", err)
+	}
+	return report, nil
+}
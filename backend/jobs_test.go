@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// En felaktig rad mitt i filen ska rulla tillbaka hela importen, både radvis och med
+// bulk, och importen ska markeras som misslyckad med raden som stoppade den
+func TestImportFailingRowRollsBack(t *testing.T) {
+	file := testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "abc", "200", "Dämpare", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "300", "Länk", "Testimportören"},
+	})
+
+	for _, bulk := range []bool{false, true} {
+		db := testDB(t)
+
+		path := filepath.Join(t.TempDir(), "test.csv")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		task := importTask{
+			filename:     "test.csv",
+			path:         path,
+			size:         int64(len(file)),
+			format:       FileFormat{Type: fileTypeCSV},
+			rootCategory: "fjädrar",
+			profile:      testProfile,
+			bulk:         bulk,
+		}
+		imp, err := createImport(db, task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.importID = imp.ID
+
+		queue := &importQueue{db: db}
+		queue.run(task)
+
+		imp, err = getImport(db, imp.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imp.State != jobFailed {
+			t.Errorf("bulk=%t: state = %q, vill ha %q", bulk, imp.State, jobFailed)
+		}
+		if imp.Error == nil || imp.Error.Row != 3 {
+			t.Errorf("bulk=%t: error = %+v, vill ha rad 3", bulk, imp.Error)
+		}
+		var outcome, productID string
+		err = db.QueryRow(`SELECT outcome, product_id FROM import_rows WHERE import_id = $1 AND row_number = 3`, imp.ID).
+			Scan(&outcome, &productID)
+		if err != nil {
+			t.Fatalf("bulk=%t: rad 3 saknas i import_rows: %v", bulk, err)
+		}
+		if outcome != rowFailed || productID != "KT200" {
+			t.Errorf("bulk=%t: rad 3 = %s %s, vill ha %s KT200", bulk, outcome, productID, rowFailed)
+		}
+
+		// Bara importen och raden som stoppade den finns kvar
+		want := map[string]int{"imports": 1, "import_rows": 1}
+		for table, n := range countRows(t, db) {
+			if n != want[table] {
+				t.Errorf("bulk=%t: %s har %d rader, vill ha %d", bulk, table, n, want[table])
+			}
+		}
+	}
+}
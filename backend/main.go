@@ -28,17 +28,62 @@ func main() {
 	if err := createSchema(db); err != nil {
 		log.Fatal("Failed to create schema:", err)
 	}
+	if err := backfillNormalizedNames(db); err != nil {
+		log.Fatal("Failed to normalize brand and model names:", err)
+	}
+
+	// start import workers
+	workers := 2
+	if v := os.Getenv("IMPORT_WORKERS"); v != "" {
+		workers, err = strconv.Atoi(v)
+		if err != nil || workers < 1 {
+			log.Fatal("Invalid IMPORT_WORKERS: ", v)
+		}
+	}
+	queue := newImportQueue(db, workers, 100)
 
 	// create router
 	router := mux.NewRouter()
 	router.HandleFunc("/brands", getBrandsHandler(db)).Methods("GET")
 	router.HandleFunc("/brands/{brand}/models", getModelsByBrandHandler(db)).Methods("GET")
 	router.HandleFunc("/brands/{brand}/models/{model}/years", getYearsHandler(db)).Methods("GET")
+	router.HandleFunc("/brands/{id:[0-9]+}/aliases", getAliasesHandler(db, brandAliases)).Methods("GET")
+	router.HandleFunc("/brands/{id:[0-9]+}/aliases", createAliasHandler(db, brandAliases)).Methods("POST")
+	router.HandleFunc("/brands/{id:[0-9]+}/aliases/{alias:[0-9]+}", deleteAliasHandler(db, brandAliases)).Methods("DELETE")
+	router.HandleFunc("/models/{id:[0-9]+}/aliases", getAliasesHandler(db, modelAliases)).Methods("GET")
+	router.HandleFunc("/models/{id:[0-9]+}/aliases", createAliasHandler(db, modelAliases)).Methods("POST")
+	router.HandleFunc("/models/{id:[0-9]+}/aliases/{alias:[0-9]+}", deleteAliasHandler(db, modelAliases)).Methods("DELETE")
+	router.HandleFunc("/brands/{id:[0-9]+}/merge", mergeHandler(db, "brand", mergeBrands)).Methods("POST")
+	router.HandleFunc("/models/{id:[0-9]+}/merge", mergeHandler(db, "model", mergeModels)).Methods("POST")
+	router.HandleFunc("/motorcycles/{id:[0-9]+}/merge", mergeHandler(db, "motorcycle", mergeMotorcycles)).Methods("POST")
+	router.HandleFunc("/merges", getMergesHandler(db)).Methods("GET")
 	router.HandleFunc("/categories", getCategoriesHandler(db)).Methods("GET")
+	router.HandleFunc("/suggest", suggestHandler(db)).Methods("GET")
 
 	router.HandleFunc("/products", getFilteredProductsHandler(db)).Methods("GET")
-
-	router.HandleFunc("/upload", uploadFileHandler(db)).Methods("POST")
+	router.HandleFunc("/products", createProductHandler(db)).Methods("POST")
+	router.HandleFunc("/products/{id}", getProductHandler(db)).Methods("GET")
+	router.HandleFunc("/products/{id}", createProductHandler(db)).Methods("POST")
+	router.HandleFunc("/products/{id}", updateProductHandler(db, false)).Methods("PUT")
+	router.HandleFunc("/products/{id}", updateProductHandler(db, true)).Methods("PATCH")
+	router.HandleFunc("/products/{id}", deleteProductHandler(db)).Methods("DELETE")
+	router.HandleFunc("/products/{id}/fitments", getFitmentsHandler(db)).Methods("GET")
+	router.HandleFunc("/products/{id}/fitments", addFitmentHandler(db)).Methods("POST")
+	router.HandleFunc("/products/{id}/fitments", replaceFitmentsHandler(db)).Methods("PUT")
+	router.HandleFunc("/products/{id}/fitments", deleteFitmentsHandler(db)).Methods("DELETE")
+	router.HandleFunc("/products/{id}/fitments/{motorcycle:[0-9]+}", deleteFitmentHandler(db)).Methods("DELETE")
+	router.HandleFunc("/products/{id}/motorcycles", getProductMotorcyclesHandler(db)).Methods("GET")
+
+	router.HandleFunc("/upload", uploadFileHandler(db, queue)).Methods("POST")
+	router.HandleFunc("/imports", getImportsHandler(db)).Methods("GET")
+	router.HandleFunc("/imports/{id:[0-9]+}", getImportHandler(db)).Methods("GET")
+	router.HandleFunc("/imports/{id:[0-9]+}/rows", getImportRowsHandler(db)).Methods("GET")
+	router.HandleFunc("/imports/{id:[0-9]+}/diff", getImportDiffHandler(db)).Methods("GET")
+	router.HandleFunc("/imports/{id:[0-9]+}/rollback", rollbackImportHandler(db)).Methods("POST")
+
+	router.HandleFunc("/profiles", getImportProfilesHandler(db)).Methods("GET")
+	router.HandleFunc("/profiles", saveImportProfileHandler(db)).Methods("POST")
+	router.HandleFunc("/profiles/{name}", getImportProfileHandler(db)).Methods("GET")
 
 	// wrap the router with CORS and JSON content type middlewares
 	enhancedRouter := enableCORS(jsonContentTypeMiddleware(router))
@@ -51,7 +96,7 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow any origin
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 		// check if the request is for CORS preflight
@@ -117,6 +162,194 @@ func createSchema(db *sql.DB) error {
 			motorcycle_id INTEGER NOT NULL REFERENCES motorcycles(id),
 			PRIMARY KEY (product_id, motorcycle_id)
 		)`,
+
+		`CREATE TABLE IF NOT EXISTS imports (
+			id SERIAL PRIMARY KEY,
+			filename VARCHAR(255) NOT NULL,
+			uploader VARCHAR(100),
+			root_category VARCHAR(100) NOT NULL,
+			profile VARCHAR(100) NOT NULL,
+			state VARCHAR(20) NOT NULL,
+			queued_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			started_at TIMESTAMPTZ,
+			finished_at TIMESTAMPTZ,
+			rows_processed INTEGER NOT NULL DEFAULT 0,
+			rows_created INTEGER NOT NULL DEFAULT 0,
+			rows_updated INTEGER NOT NULL DEFAULT 0,
+			rows_skipped INTEGER NOT NULL DEFAULT 0,
+			rows_failed INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			error_row INTEGER
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS import_rows (
+			import_id INTEGER NOT NULL REFERENCES imports(id),
+			row_number INTEGER NOT NULL,
+			outcome VARCHAR(10) NOT NULL,
+			product_id VARCHAR(50),
+			message TEXT,
+			PRIMARY KEY (import_id, row_number)
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_import_rows_product_id ON import_rows(product_id)`,
+
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS rolled_back_at TIMESTAMPTZ`,
+
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS method VARCHAR(10) NOT NULL DEFAULT 'rows'`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS bytes_total BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS bytes_processed BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS encoding VARCHAR(50) NOT NULL DEFAULT ''`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS delimiter VARCHAR(4) NOT NULL DEFAULT ''`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS encoding_detected BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS delimiter_detected BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS file_type VARCHAR(10) NOT NULL DEFAULT 'csv'`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS sheet VARCHAR(100) NOT NULL DEFAULT ''`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS mode VARCHAR(10) NOT NULL DEFAULT 'upsert'`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS unknown_names VARCHAR(10) NOT NULL DEFAULT 'create'`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS match_threshold DOUBLE PRECISION NOT NULL DEFAULT 0.85`,
+		`ALTER TABLE imports ADD COLUMN IF NOT EXISTS rows_held INTEGER NOT NULL DEFAULT 0`,
+
+		// Produkter som en sync-import inte längre hittar i leverantörens fil
+		`ALTER TABLE products ADD COLUMN IF NOT EXISTS discontinued_at TIMESTAMPTZ`,
+
+		// Fritextsökning i /products (q). search_vector hålls uppdaterad av en trigger och
+		// väger id och namn högst, sedan kategorisökvägen, importören och beskrivningen.
+		`ALTER TABLE products ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE OR REPLACE FUNCTION product_search_vector(
+			p_id TEXT, p_name TEXT, p_description TEXT, p_importer TEXT, p_category_id INTEGER
+		) RETURNS tsvector LANGUAGE sql STABLE AS $$
+			WITH category AS (
+				SELECT COALESCE(string_agg(a.name, ' ' ORDER BY a.level), '') AS path
+				FROM categories c
+				JOIN categories a ON c.path LIKE a.path || '%'
+				WHERE c.id = p_category_id
+			)
+			SELECT
+				setweight(to_tsvector('simple', COALESCE(p_id, '')), 'A') ||
+				setweight(to_tsvector('swedish', COALESCE(p_name, '')), 'A') ||
+				setweight(to_tsvector('english', COALESCE(p_name, '')), 'A') ||
+				setweight(to_tsvector('swedish', category.path), 'B') ||
+				setweight(to_tsvector('english', category.path), 'B') ||
+				setweight(to_tsvector('simple', COALESCE(p_importer, '')), 'C') ||
+				setweight(to_tsvector('swedish', COALESCE(p_description, '')), 'D') ||
+				setweight(to_tsvector('english', COALESCE(p_description, '')), 'D')
+			FROM category
+		$$`,
+		`CREATE OR REPLACE FUNCTION products_search_vector_trigger() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			NEW.search_vector := product_search_vector(NEW.id, NEW.name, NEW.description, NEW.importer_name, NEW.category_id);
+			RETURN NEW;
+		END
+		$$`,
+		`DROP TRIGGER IF EXISTS products_search_vector ON products`,
+		`CREATE TRIGGER products_search_vector
+			BEFORE INSERT OR UPDATE OF id, name, description, importer_name, category_id ON products
+			FOR EACH ROW EXECUTE FUNCTION products_search_vector_trigger()`,
+		// Kategorisökvägen ingår i search_vector, så produkterna under en kategori som byter
+		// namn eller flyttas måste räknas om. path ingår eftersom den sätts efter parent_id.
+		`CREATE OR REPLACE FUNCTION categories_search_vector_trigger() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			UPDATE products p
+			SET search_vector = product_search_vector(p.id, p.name, p.description, p.importer_name, p.category_id)
+			FROM categories c
+			WHERE c.id = p.category_id AND c.path LIKE NEW.path || '%';
+			RETURN NULL;
+		END
+		$$`,
+		`DROP TRIGGER IF EXISTS categories_search_vector ON categories`,
+		`CREATE TRIGGER categories_search_vector
+			AFTER UPDATE OF name, parent_id, path ON categories
+			FOR EACH ROW
+			WHEN (OLD.name IS DISTINCT FROM NEW.name OR OLD.parent_id IS DISTINCT FROM NEW.parent_id OR OLD.path IS DISTINCT FROM NEW.path)
+			EXECUTE FUNCTION categories_search_vector_trigger()`,
+		`UPDATE products
+		SET search_vector = product_search_vector(id, name, description, importer_name, category_id)
+		WHERE search_vector IS NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_products_search_vector ON products USING GIN (search_vector)`,
+
+		// Trigramindex för /suggest, som matchar på början av, mitt i och liknande namn
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS idx_brands_name_trgm ON brands USING GIN (name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_models_name_trgm ON models USING GIN (name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_motorcycles_full_name_trgm ON motorcycles USING GIN (full_name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_categories_name_trgm ON categories USING GIN (name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_products_id_trgm ON products USING GIN (id gin_trgm_ops)`,
+
+		// Märken och modeller matchas på normaliserat namn och alias, se normalizeName.
+		// normalized_name fylls i för befintliga rader av backfillNormalizedNames.
+		`ALTER TABLE brands ADD COLUMN IF NOT EXISTS normalized_name VARCHAR(100)`,
+		`ALTER TABLE models ADD COLUMN IF NOT EXISTS normalized_name VARCHAR(100)`,
+		`CREATE INDEX IF NOT EXISTS idx_brands_normalized_name ON brands(normalized_name)`,
+		`CREATE INDEX IF NOT EXISTS idx_models_brand_normalized_name ON models(brand_id, normalized_name)`,
+
+		`CREATE TABLE IF NOT EXISTS brand_aliases (
+			id SERIAL PRIMARY KEY,
+			brand_id INTEGER NOT NULL REFERENCES brands(id) ON DELETE CASCADE,
+			alias VARCHAR(100) NOT NULL,
+			normalized VARCHAR(100) UNIQUE NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS model_aliases (
+			id SERIAL PRIMARY KEY,
+			model_id INTEGER NOT NULL REFERENCES models(id) ON DELETE CASCADE,
+			brand_id INTEGER NOT NULL REFERENCES brands(id) ON DELETE CASCADE,
+			alias VARCHAR(100) NOT NULL,
+			normalized VARCHAR(100) NOT NULL,
+			UNIQUE (brand_id, normalized)
+		)`,
+
+		// Sammanslagningar av dubbletter, för spårbarhet
+		`CREATE TABLE IF NOT EXISTS merges (
+			id SERIAL PRIMARY KEY,
+			entity VARCHAR(20) NOT NULL,
+			survivor_id INTEGER NOT NULL,
+			merged_ids INTEGER[] NOT NULL,
+			merged_names TEXT[] NOT NULL,
+			repointed JSONB NOT NULL,
+			merged JSONB NOT NULL,
+			merged_by VARCHAR(100),
+			merged_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS import_changes (
+			id SERIAL PRIMARY KEY,
+			import_id INTEGER NOT NULL REFERENCES imports(id),
+			entity VARCHAR(20) NOT NULL,
+			action VARCHAR(20) NOT NULL,
+			entity_id VARCHAR(50) NOT NULL,
+			related_id INTEGER,
+			previous JSONB
+		)`,
+
+		`CREATE INDEX IF NOT EXISTS idx_import_changes_import_id ON import_changes(import_id)`,
+
+		// Senaste ändringen som inte kom från en import, som en rollback inte får skriva över
+		`ALTER TABLE products ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ`,
+
+		`CREATE TABLE IF NOT EXISTS import_profiles (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) UNIQUE NOT NULL,
+			category_column VARCHAR(100) NOT NULL,
+			brand_column VARCHAR(100) NOT NULL,
+			model_column VARCHAR(100) NOT NULL,
+			years_column VARCHAR(100) NOT NULL,
+			product_code_column VARCHAR(100) NOT NULL,
+			product_name_column VARCHAR(100) NOT NULL,
+			importer_column VARCHAR(100) NOT NULL,
+			code_prefix VARCHAR(20) NOT NULL DEFAULT '',
+			delimiter VARCHAR(4) NOT NULL DEFAULT 'auto',
+			encoding VARCHAR(50) NOT NULL DEFAULT 'auto'
+		)`,
+
+		// Nya profiler känner igen avgränsare och teckenkodning i varje fil om inget anges
+		`ALTER TABLE import_profiles ALTER COLUMN delimiter SET DEFAULT 'auto'`,
+		`ALTER TABLE import_profiles ALTER COLUMN encoding SET DEFAULT 'auto'`,
+
+		// Standardprofilen motsvarar den ursprungliga leverantörens filformat
+		`INSERT INTO import_profiles (name, category_column, brand_column, model_column, years_column,
+			product_code_column, product_name_column, importer_column, code_prefix, delimiter, encoding)
+		VALUES ('default', '0', '4', '5', '6', '9', '10', '18', 'KT', 'auto', 'auto')
+		ON CONFLICT (name) DO NOTHING`,
 	}
 
 	for i, q := range queries {
@@ -270,73 +503,123 @@ func getFilteredProductsHandler(db *sql.DB) http.HandlerFunc {
 		model := queryParams.Get("model")
 		yearStr := queryParams.Get("year")
 		categoryIDStr := queryParams.Get("category_id")
+		search := strings.TrimSpace(queryParams.Get("q"))
+
+		fitmentLimit, err := parseFitmentLimit(queryParams.Get("fitment_limit"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit, offset, err := parsePaging(r, 50, 500)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sort, err := parseProductSort(queryParams.Get("sort"), queryParams.Get("order"), search != "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		facets, err := parseFacets(queryParams.Get("facets"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var includeUniversal bool
+		switch queryParams.Get("include_universal") {
+		case "", "true":
+			includeUniversal = true
+		case "false":
+			includeUniversal = false
+		default:
+			http.Error(w, "Invalid include_universal, expected true or false", http.StatusBadRequest)
+			return
+		}
+
+		// Utan motorcykelfilter finns inga kopplingar att visa i stället för universalprodukterna
+		if !includeUniversal && brand == "" && model == "" && yearStr == "" {
+			http.Error(w, "include_universal=false requires a brand, model or year filter", http.StatusBadRequest)
+			return
+		}
+
+		var cursor *productCursor
+		if v := queryParams.Get("cursor"); v != "" {
+			if queryParams.Get("offset") != "" {
+				http.Error(w, "Use either cursor or offset, not both", http.StatusBadRequest)
+				return
+			}
+			cursor, err = decodeProductCursor(v, sort)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
 		var startyear, endyear int
-		var err error
 
 		if yearStr != "" {
 			startyear, endyear, err = extractYears(yearStr)
 			if err != nil {
 				log.Printf("Error when extracting years: %v", err)
-				http.Error(w, "Error when extracting years", http.StatusBadRequest)
+				http.Error(w, fmt.Sprintf("Invalid year %q, expected a year like 2021 or a range like 2019-2023, 2019+ or -2018", yearStr), http.StatusBadRequest)
 				return
 			}
 		}
 
-		baseQuery := `
-			WITH RECURSIVE category_tree AS (
-				SELECT id, name, parent_id, '/' || id || '/' AS path
-				FROM categories
-				WHERE parent_id IS NULL
-				UNION ALL
-				SELECT c.id, c.name, c.parent_id, ct.path || c.id || '/'
-				FROM categories c
-				JOIN category_tree ct ON c.parent_id = ct.id
-			),
-			category_paths AS (
-				SELECT c1.id AS category_id, string_agg(c2.name, '/' ORDER BY position) AS full_category_path
-				FROM category_tree c1
-				JOIN category_tree c2 ON c1.path LIKE '%/' || c2.id || '/%'
-				JOIN LATERAL (
-					SELECT position
-					FROM regexp_split_to_table(c1.path, '/') WITH ORDINALITY AS t(part, position)
-					WHERE part = c2.id::text
-					LIMIT 1
-				) pos ON true
-				GROUP BY c1.id
-			)
-
-		SELECT DISTINCT 
-			p.id, p.name, p.category_id, cp.full_category_path,
-			p.description, p.for_brand, p.is_universal, p.importer_name
-		FROM products p
-		LEFT JOIN product_compatibility pc ON p.id = pc.product_id
-		LEFT JOIN motorcycles m ON pc.motorcycle_id = m.id
-		LEFT JOIN brands b ON m.brand_id = b.id
-		LEFT JOIN models mo ON m.model_id = mo.id
-		LEFT JOIN categories c ON p.category_id = c.id
-		LEFT JOIN category_paths cp ON p.category_id = cp.category_id
-		`
 		whereClauses := []string{}
 		args := []interface{}{}
 		argPos := 1
 
+		// Filtren på motorcykel
+		bikeClauses := []string{}
+		brandPos := 0
 		if brand != "" {
-			whereClauses = append(whereClauses, fmt.Sprintf("b.name ILIKE $%d", argPos))
+			bikeClauses = append(bikeClauses, fmt.Sprintf("b.name ILIKE $%d", argPos))
 			args = append(args, brand)
+			brandPos = argPos
 			argPos++
 		}
 		if model != "" {
-			whereClauses = append(whereClauses, fmt.Sprintf("mo.name ILIKE $%d", argPos))
+			bikeClauses = append(bikeClauses, fmt.Sprintf("mo.name ILIKE $%d", argPos))
 			args = append(args, model)
 			argPos++
 		}
+		// Motorcykelns årsmodeller ska överlappa det efterfrågade intervallet, så ett
+		// enskilt år ger motorcyklar vars intervall innehåller året och "2019+" ger
+		// motorcyklar som tillverkades 2019 eller senare
 		if yearStr != "" {
-			whereClauses = append(whereClauses,
+			bikeClauses = append(bikeClauses,
 				fmt.Sprintf("m.startyear <= $%d AND m.endyear >= $%d", argPos, argPos+1))
-			args = append(args, startyear, endyear)
+			args = append(args, endyear, startyear)
 			argPos += 2
 		}
+		// Om produkten har en koppling till en motorcykel som matchar filtren, se fitType
+		fitsBike := "FALSE"
+		if len(bikeClauses) > 0 {
+			bikeFilter := strings.Join(bikeClauses, " AND ")
+			fitsBike = `EXISTS (
+				SELECT 1
+				FROM product_compatibility pc
+				JOIN motorcycles m ON pc.motorcycle_id = m.id
+				JOIN brands b ON m.brand_id = b.id
+				JOIN models mo ON m.model_id = mo.id
+				WHERE pc.product_id = p.id AND ` + bikeFilter + `
+			)`
+			// Universalprodukter har inga kopplingar men passar alla motorcyklar, utom
+			// när de är gjorda för ett annat märke
+			if includeUniversal {
+				universal := "p.is_universal = TRUE"
+				if brandPos > 0 {
+					universal += fmt.Sprintf(" AND (COALESCE(p.for_brand, '') = '' OR p.for_brand ILIKE $%d)", brandPos)
+				}
+				bikeFilter = "((" + bikeFilter + ") OR (" + universal + "))"
+			}
+			whereClauses = append(whereClauses, bikeFilter)
+		}
 
 		if categoryIDStr != "" {
 			catID, err := strconv.Atoi(categoryIDStr)
@@ -350,15 +633,98 @@ func getFilteredProductsHandler(db *sql.DB) http.HandlerFunc {
 			argPos++
 		}
 
+		// Fritextsökning i search_vector, rankad med ts_rank
+		relevance := "0"
+		if search != "" {
+			tsQuery := fmt.Sprintf(productSearchQuery, argPos, argPos)
+			whereClauses = append(whereClauses, "p.search_vector @@ "+tsQuery)
+			relevance = fmt.Sprintf(productRelevance, tsQuery)
+			args = append(args, search)
+			argPos++
+		}
+		if sort.name == "relevance" {
+			sort.expr = relevance
+		}
+
 		// Om inga specifika filters är satta → visa bara universella produkter
 		if len(whereClauses) == 0 {
 			whereClauses = append(whereClauses, "p.is_universal = TRUE")
 		}
+		// Utgångna produkter visas inte
+		whereClauses = append(whereClauses, "p.discontinued_at IS NULL")
+
+		// Id:n för alla produkter som matchar filtren
+		filterQuery := `
+			SELECT DISTINCT p.id
+			FROM products p
+			LEFT JOIN product_compatibility pc ON p.id = pc.product_id
+			LEFT JOIN motorcycles m ON pc.motorcycle_id = m.id
+			LEFT JOIN brands b ON m.brand_id = b.id
+			LEFT JOIN models mo ON m.model_id = mo.id
+			LEFT JOIN categories c ON p.category_id = c.id
+			WHERE ` + strings.Join(whereClauses, " AND ")
+
+		page := ProductPage{Items: []Product{}}
+		if err := db.QueryRow(`SELECT COUNT(*) FROM (`+filterQuery+`) f`, args...).Scan(&page.Total); err != nil {
+			log.Printf("Database query error: %v\n", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
 
-		finalQuery := baseQuery + " WHERE " + strings.Join(whereClauses, " AND ")
-		log.Printf("Executing SQL:\n%s\nWith args: %+v\n", finalQuery, args)
+		if len(facets) > 0 {
+			page.Facets, err = countFacets(db, facets, filterQuery, args)
+			if err != nil {
+				log.Printf("Database query error: %v\n", err)
+				http.Error(w, "Database query error", http.StatusInternalServerError)
+				return
+			}
+		}
 
-		rows, err := db.Query(finalQuery, args...)
+		pageQuery := `
+			WITH RECURSIVE category_tree AS (
+				SELECT id, name, parent_id, '/' || id || '/' AS path
+				FROM categories
+				WHERE parent_id IS NULL
+				UNION ALL
+				SELECT c.id, c.name, c.parent_id, ct.path || c.id || '/'
+				FROM categories c
+				JOIN category_tree ct ON c.parent_id = ct.id
+			),
+			category_paths AS (
+				SELECT c1.id AS category_id, string_agg(c2.name, '/' ORDER BY position) AS full_category_path
+				FROM category_tree c1
+				JOIN category_tree c2 ON c1.path LIKE '%/' || c2.id || '/%'
+				JOIN LATERAL (
+					SELECT position
+					FROM regexp_split_to_table(c1.path, '/') WITH ORDINALITY AS t(part, position)
+					WHERE part = c2.id::text
+					LIMIT 1
+				) pos ON true
+				GROUP BY c1.id
+			)
+
+		SELECT
+			p.id, p.name, p.category_id, COALESCE(cp.full_category_path, ''),
+			COALESCE(p.description, ''), COALESCE(p.for_brand, ''), COALESCE(p.is_universal, false),
+			COALESCE(p.importer_name, ''),
+			(SELECT COUNT(*) FROM product_compatibility fc WHERE fc.product_id = p.id) AS fitment_count,
+			` + relevance + ` AS relevance,
+			` + fitsBike + ` AS fits_bike
+		FROM products p
+		LEFT JOIN category_paths cp ON p.category_id = cp.category_id
+		WHERE p.id IN (` + filterQuery + `)`
+
+		if cursor != nil {
+			pageQuery += fmt.Sprintf(" AND (%s, p.id) %s ($%d, $%d)", sort.expr, sort.after(), argPos, argPos+1)
+			args = append(args, cursor.Value, cursor.ID)
+			argPos += 2
+		}
+		// En rad extra för att se om det finns en sida till
+		pageQuery += fmt.Sprintf(" ORDER BY %s %s, p.id %s LIMIT $%d OFFSET $%d",
+			sort.expr, sort.order, sort.order, argPos, argPos+1)
+		args = append(args, limit+1, offset)
+
+		rows, err := db.Query(pageQuery, args...)
 		if err != nil {
 			log.Printf("Database query error: %v\n", err)
 			http.Error(w, "Database query error", http.StatusInternalServerError)
@@ -366,112 +732,107 @@ func getFilteredProductsHandler(db *sql.DB) http.HandlerFunc {
 		}
 		defer rows.Close()
 
-		products, err := extractProductsFromRows(rows, db)
+		products, err := extractProductsFromRows(rows, db, fitmentLimit)
 		if err != nil {
 			http.Error(w, "Error scanning product", http.StatusInternalServerError)
 			return
 		}
 
+		if len(products) > limit {
+			products = products[:limit]
+			page.NextCursor = encodeProductCursor(sort, products[limit-1])
+		}
+		if products != nil {
+			page.Items = products
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(products)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
+// extractYears tolkar year i /products: ett år ("2021") eller ett intervall i samma
+// format som årsmodellerna i importen ("2019-2023", "2019+", "-2018"). Listor stöds inte.
 func extractYears(yearString string) (int, int, error) {
-	yearsSplit := strings.Split(yearString, "-")
-	if len(yearsSplit) != 2 {
-		return 0, 0, nil
-	}
-	startyear, err := strconv.Atoi(yearsSplit[0])
+	years, err := parseModelYears(yearString)
 	if err != nil {
 		return 0, 0, err
 	}
-	endyear, err := strconv.Atoi(yearsSplit[1])
-	if err != nil {
-		return 0, 0, err
+	if len(years) != 1 {
+		return 0, 0, fmt.Errorf("%q är en lista, inte ett år eller intervall", yearString)
 	}
+	return years[0].StartYear, years[0].EndYear, nil
+}
+
+// Hur en produkt passar motorcykeln i filtren, se Product.FitType
+const (
+	fitExact     = "exact"
+	fitUniversal = "universal"
+)
 
-	return startyear, endyear, nil
+// Hur många motorcyklar varje produkt i /products visar om fitment_limit inte är satt.
+// Alla finns via /products/{id}/motorcycles och antalet i fitment_count.
+const defaultFitmentLimit = 10
+
+// parseFitmentLimit tolkar fitment_limit: ett icke-negativt heltal eller "all"
+func parseFitmentLimit(v string) (int, error) {
+	switch v {
+	case "":
+		return defaultFitmentLimit, nil
+	case "all":
+		return -1, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("fitment_limit must be a non-negative integer or all")
+	}
+	return limit, nil
 }
 
-func extractProductsFromRows(rows *sql.Rows, db *sql.DB) ([]Product, error) {
-	var err error
+// fitType är exact för produkter som är kopplade till en motorcykel som matchar
+// filtren (fitsBike). Annars är universalprodukter universal och övriga exact.
+func fitType(p Product, fitsBike bool) string {
+	if !fitsBike && p.IsUniversal {
+		return fitUniversal
+	}
+	return fitExact
+}
 
+// extractProductsFromRows läser produkterna och hämtar sedan motorcyklarna för alla
+// produkter på en gång, i stället för en fråga per produkt
+func extractProductsFromRows(rows *sql.Rows, db *sql.DB, fitmentLimit int) ([]Product, error) {
 	var products []Product
+	var ids []string
 
 	for rows.Next() {
 		var p Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.CategoryPath, &p.Description, &p.ForBrand, &p.IsUniversal, &p.ImporterName); err != nil {
+		var fitsBike bool
+		if err := rows.Scan(&p.ID, &p.Name, &p.CategoryID, &p.CategoryPath, &p.Description, &p.ForBrand, &p.IsUniversal, &p.ImporterName, &p.FitmentCount, &p.Relevance, &fitsBike); err != nil {
 			log.Printf("Error scanning product: %v\n", err)
 			return nil, err
 		}
-
-		p.Motorcycles, err = extractMotorcyclesForProduct(p.ID, db)
-		if err != nil {
-			return nil, err
-		}
+		p.Motorcycles = []Motorcycle{}
+		p.FitType = fitType(p, fitsBike)
 		products = append(products, p)
+		ids = append(ids, p.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(products) == 0 || fitmentLimit == 0 {
+		return products, nil
 	}
 
-	return products, nil
-}
-
-func extractMotorcyclesForProduct(prodID string, db *sql.DB) ([]Motorcycle, error) {
-	// Hämta motorcyklar för produkten
-	mcRows, err := db.Query(`
-				SELECT m.id, b.name, mo.name, m.startyear, m.endyear
-				FROM product_compatibility pc
-				JOIN motorcycles m ON pc.motorcycle_id = m.id
-				JOIN brands b ON m.brand_id = b.id
-				JOIN models mo ON m.model_id = mo.id
-				WHERE pc.product_id = $1
-				LIMIT 10
-				`, prodID)
+	fitments, err := fitmentsForProducts(db, ids, fitmentLimit)
 	if err != nil {
 		log.Printf("Error querying motorcycles: %v\n", err)
 		return nil, err
 	}
-
-	defer mcRows.Close()
-	var motorcycles []Motorcycle
-	for mcRows.Next() {
-		var m Motorcycle
-		if err := mcRows.Scan(&m.ID, &m.Brand, &m.Model, &m.StartYear, &m.EndYear); err != nil {
-			log.Printf("Error scanning motorcycle: %v\n", err)
-			continue
+	for i := range products {
+		if motorcycles, ok := fitments[products[i].ID]; ok {
+			products[i].Motorcycles = motorcycles
 		}
-		motorcycles = append(motorcycles, m)
 	}
 
-	return motorcycles, nil
-}
-
-func uploadFileHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseMultipartForm(30 << 20)
-		if err != nil {
-			http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
-			return
-		}
-
-		rootCategory := r.FormValue("category")
-		if rootCategory == "" {
-			http.Error(w, "Category is required", http.StatusBadRequest)
-			return
-		}
-
-		file, handler, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "Could not get file", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-
-		if !strings.HasSuffix(strings.ToLower(handler.Filename), ".csv") {
-			http.Error(w, "Only .csv files allowed", http.StatusBadRequest)
-			return
-		}
-
-		csvreader(file, db, rootCategory)
-	}
+	return products, nil
 }
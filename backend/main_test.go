@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// listProducts anropar GET /products med query och returnerar sidan
+func listProducts(t *testing.T, db *sql.DB, query string) ProductPage {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	getFilteredProductsHandler(db)(rec, httptest.NewRequest(http.MethodGet, "/products?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /products?%s: %d %s", query, rec.Code, rec.Body)
+	}
+
+	var page ProductPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func productIDs(page ProductPage) []string {
+	ids := []string{}
+	for _, p := range page.Items {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// Alla motorcyklar har slutna intervall. Ett år, ett intervall och öppna intervall ska
+// ge motorcyklarna med minst en årsmodell i det efterfrågade intervallet.
+func TestProductsYearFilter(t *testing.T) {
+	db := testDB(t)
+
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2015-2016", "1", "Produkt 1", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2017-2018", "2", "Produkt 2", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2020", "3", "Produkt 3", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2021-2023", "4", "Produkt 4", "Testimportören"},
+	}), false, importOptions{})
+
+	tests := []struct {
+		year string
+		want []string
+	}{
+		{"2019", []string{"KT3"}},
+		{"2019%2B", []string{"KT3", "KT4"}}, // 2019+
+		{"-2018", []string{"KT1", "KT2"}},
+		{"2015-2018", []string{"KT1", "KT2"}},
+		{"2016-2019", []string{"KT1", "KT2", "KT3"}},
+		{"2024", []string{}},
+	}
+	for _, tt := range tests {
+		page := listProducts(t, db, "include_universal=false&year="+tt.year)
+		if got := productIDs(page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("year=%s: fick %v, vill ha %v", tt.year, got, tt.want)
+		}
+	}
+}
+
+// En universalprodukt som även är kopplad till den filtrerade motorcykeln är exact
+func TestProductsFitType(t *testing.T) {
+	db := testDB(t)
+
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2020", "1", "Produkt 1", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2020", "2", "Produkt 2", "Testimportören"},
+		{"Bakfjädrar", "", "", "", "3", "Produkt 3", "Testimportören"},
+	}), false, importOptions{})
+	if _, err := db.Exec(`UPDATE products SET is_universal = TRUE WHERE id = 'KT2'`); err != nil {
+		t.Fatal(err)
+	}
+
+	fitTypes := func(page ProductPage) map[string]string {
+		types := map[string]string{}
+		for _, p := range page.Items {
+			types[p.ID] = p.FitType
+		}
+		return types
+	}
+
+	got := fitTypes(listProducts(t, db, "brand=KTM&year=2019"))
+	want := map[string]string{"KT1": fitExact, "KT2": fitExact, "KT3": fitUniversal}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("brand=KTM&year=2019: fick %v, vill ha %v", got, want)
+	}
+
+	// KT2 matchar inte längre på sin koppling utan bara för att den är universal
+	got = fitTypes(listProducts(t, db, "brand=KTM&year=2022"))
+	want = map[string]string{"KT2": fitUniversal, "KT3": fitUniversal}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("brand=KTM&year=2022: fick %v, vill ha %v", got, want)
+	}
+}
+
+// Utan motorcykelfilter skulle include_universal=false inte lämna något att visa
+func TestProductsExcludeUniversalNeedsBikeFilter(t *testing.T) {
+	for _, query := range []string{"include_universal=false", "include_universal=false&category_id=1", "include_universal=false&q=oil"} {
+		rec := httptest.NewRecorder()
+		getFilteredProductsHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/products?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /products?%s: %d, vill ha 400", query, rec.Code)
+		}
+	}
+}
+
+// Kategorisökvägen ingår i search_vector, så sökningen ska följa med när en överordnad
+// kategori byter namn och när en kategori flyttas
+func TestProductsSearchFollowsCategory(t *testing.T) {
+	db := testDB(t)
+
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2020", "1", "Produkt 1", "Testimportören"},
+	}), false, importOptions{})
+
+	if _, err := db.Exec(`UPDATE categories SET name = 'Dämpning' WHERE name = 'fjädrar'`); err != nil {
+		t.Fatal(err)
+	}
+	if got := productIDs(listProducts(t, db, "q=dämpning")); !reflect.DeepEqual(got, []string{"KT1"}) {
+		t.Errorf("q=dämpning efter namnbyte: fick %v, vill ha [KT1]", got)
+	}
+
+	parentID, _, err := getOrCreateCategoryWithParent(db, "Reservdelar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+		UPDATE categories SET parent_id = $1, path = '/' || $1 || '/' || id || '/', level = 1
+		WHERE name = 'Bakfjädrar'
+	`, parentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := productIDs(listProducts(t, db, "q=reservdelar")); !reflect.DeepEqual(got, []string{"KT1"}) {
+		t.Errorf("q=reservdelar efter flytt: fick %v, vill ha [KT1]", got)
+	}
+	if got := productIDs(listProducts(t, db, "q=dämpning")); len(got) != 0 {
+		t.Errorf("q=dämpning efter flytt: fick %v, vill ha inga", got)
+	}
+}
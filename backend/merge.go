@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Vad som räknas i en sammanslagning. repointed är rader som flyttats till den
+// kvarvarande posten, merged är rader som slagits ihop med en befintlig rad.
+const (
+	countModels      = "models"
+	countMotorcycles = "motorcycles"
+	countFitments    = "fitments"
+	countAliases     = "aliases"
+)
+
+// mergeNotFoundError returneras när en post som ska slås ihop inte finns
+type mergeNotFoundError struct {
+	entity string
+	id     int
+}
+
+func (e *mergeNotFoundError) Error() string {
+	return fmt.Sprintf("%s %d not found", e.entity, e.id)
+}
+
+// Modeller slås bara ihop inom ett märke och motorcyklar inom en modell
+var (
+	errMergeBrandMismatch = errors.New("models can only be merged within the same brand, merge the brands first")
+	errMergeModelMismatch = errors.New("motorcycles can only be merged within the same model, merge the models first")
+)
+
+// mergeFunc slår ihop dubbletterna ids med posten survivorID inom tx
+type mergeFunc func(tx *sql.Tx, survivorID int, ids []int, result *MergeResult) error
+
+func newMergeResult(entity string, survivorID int, ids []int) *MergeResult {
+	return &MergeResult{
+		Entity:     entity,
+		SurvivorID: survivorID,
+		MergedIDs:  ids,
+		Repointed:  map[string]int{},
+		Merged:     map[string]int{},
+	}
+}
+
+// mergeBrands slår ihop märkena ids med survivorID. Modeller som har samma normaliserade
+// namn som en modell hos survivorID slås ihop med den, övriga flyttas över.
+func mergeBrands(tx *sql.Tx, survivorID int, ids []int, result *MergeResult) error {
+	var target namedID
+	var targetNormalized string
+	err := tx.QueryRow(`SELECT id, name, normalized_name FROM brands WHERE id = $1 FOR UPDATE`, survivorID).
+		Scan(&target.id, &target.name, &targetNormalized)
+	if err == sql.ErrNoRows {
+		return &mergeNotFoundError{"brand", survivorID}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var name string
+		err := tx.QueryRow(`SELECT name FROM brands WHERE id = $1 FOR UPDATE`, id).Scan(&name)
+		if err == sql.ErrNoRows {
+			return &mergeNotFoundError{"brand", id}
+		}
+		if err != nil {
+			return err
+		}
+		result.MergedNames = append(result.MergedNames, name)
+
+		// Hämta alla modeller först; pq klarar inte nya frågor medan rows är öppen
+		rows, err := tx.Query(`SELECT id, name FROM models WHERE brand_id = $1 ORDER BY id`, id)
+		if err != nil {
+			return err
+		}
+		var models []namedID
+		for rows.Next() {
+			var m namedID
+			if err := rows.Scan(&m.id, &m.name); err != nil {
+				rows.Close()
+				return err
+			}
+			models = append(models, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, m := range models {
+			// Matchningen görs per modell så att dubbletter inom märket också slås ihop
+			var matchID sql.NullInt64
+			err := tx.QueryRow(`
+				SELECT min(t.id) FROM models t
+				WHERE t.brand_id = $1 AND t.normalized_name = (SELECT normalized_name FROM models WHERE id = $2)
+			`, survivorID, m.id).Scan(&matchID)
+			if err != nil {
+				return err
+			}
+			if matchID.Valid {
+				err = mergeModelInto(tx, int(matchID.Int64), m.id, result)
+			} else {
+				err = moveModel(tx, target, m, result)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Exec(`UPDATE brand_aliases SET brand_id = $1 WHERE brand_id = $2`, survivorID, id)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		result.Repointed[countAliases] += int(n)
+
+		// Det gamla namnet blir ett alias så att nästa import hamnar rätt
+		_, err = tx.Exec(`
+			INSERT INTO brand_aliases (brand_id, alias, normalized)
+			SELECT $1, name, normalized_name FROM brands
+			WHERE id = $2 AND normalized_name <> $3
+			ON CONFLICT (normalized) DO NOTHING
+		`, survivorID, id, targetNormalized)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM brands WHERE id = $1`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveModel flyttar en modell med dess motorcyklar och alias till ett annat märke
+func moveModel(tx *sql.Tx, brand namedID, model namedID, result *MergeResult) error {
+	if _, err := tx.Exec(`UPDATE models SET brand_id = $1 WHERE id = $2`, brand.id, model.id); err != nil {
+		return err
+	}
+	result.Repointed[countModels]++
+
+	res, err := tx.Exec(`
+		UPDATE motorcycles SET brand_id = $1, full_name = $2 || ' ' || startyear || '-' || endyear
+		WHERE model_id = $3
+	`, brand.id, brand.name+" "+model.name, model.id)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	result.Repointed[countMotorcycles] += int(n)
+
+	// Alias som märket redan har för en annan modell kan inte följa med
+	_, err = tx.Exec(`
+		DELETE FROM model_aliases a
+		WHERE a.model_id = $2
+		AND EXISTS (SELECT 1 FROM model_aliases o WHERE o.brand_id = $1 AND o.normalized = a.normalized)
+	`, brand.id, model.id)
+	if err != nil {
+		return err
+	}
+	res, err = tx.Exec(`UPDATE model_aliases SET brand_id = $1 WHERE model_id = $2`, brand.id, model.id)
+	if err != nil {
+		return err
+	}
+	n, _ = res.RowsAffected()
+	result.Repointed[countAliases] += int(n)
+	return nil
+}
+
+func mergeModels(tx *sql.Tx, survivorID int, ids []int, result *MergeResult) error {
+	var brandID int
+	err := tx.QueryRow(`SELECT brand_id FROM models WHERE id = $1 FOR UPDATE`, survivorID).Scan(&brandID)
+	if err == sql.ErrNoRows {
+		return &mergeNotFoundError{"model", survivorID}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var otherBrandID int
+		var name string
+		err := tx.QueryRow(`SELECT brand_id, name FROM models WHERE id = $1 FOR UPDATE`, id).Scan(&otherBrandID, &name)
+		if err == sql.ErrNoRows {
+			return &mergeNotFoundError{"model", id}
+		}
+		if err != nil {
+			return err
+		}
+		if otherBrandID != brandID {
+			return errMergeBrandMismatch
+		}
+		result.MergedNames = append(result.MergedNames, name)
+
+		if err := mergeModelInto(tx, survivorID, id, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeModelInto slår ihop modellen sourceID med targetID, som kan höra till ett annat
+// märke när märken slås ihop. Motorcyklar med samma årsintervall slås ihop, övriga flyttas.
+func mergeModelInto(tx *sql.Tx, targetID, sourceID int, result *MergeResult) error {
+	var brand, model namedID
+	var normalized string
+	err := tx.QueryRow(`
+		SELECT b.id, b.name, mo.id, mo.name, mo.normalized_name
+		FROM models mo JOIN brands b ON b.id = mo.brand_id
+		WHERE mo.id = $1
+	`, targetID).Scan(&brand.id, &brand.name, &model.id, &model.name, &normalized)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT d.id, (
+			SELECT t.id FROM motorcycles t
+			WHERE t.model_id = $1 AND t.startyear = d.startyear AND t.endyear = d.endyear
+		)
+		FROM motorcycles d
+		WHERE d.model_id = $2
+	`, targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	type sourceMotorcycle struct {
+		id      int
+		matchID sql.NullInt64
+	}
+	var motorcycles []sourceMotorcycle
+	for rows.Next() {
+		var m sourceMotorcycle
+		if err := rows.Scan(&m.id, &m.matchID); err != nil {
+			rows.Close()
+			return err
+		}
+		motorcycles = append(motorcycles, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range motorcycles {
+		if m.matchID.Valid {
+			if err := mergeMotorcycleInto(tx, int(m.matchID.Int64), m.id, result); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err := tx.Exec(`
+			UPDATE motorcycles SET brand_id = $1, model_id = $2, full_name = $3 || ' ' || startyear || '-' || endyear
+			WHERE id = $4
+		`, brand.id, model.id, brand.name+" "+model.name, m.id)
+		if err != nil {
+			return err
+		}
+		result.Repointed[countMotorcycles]++
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM model_aliases a
+		WHERE a.model_id = $2
+		AND EXISTS (SELECT 1 FROM model_aliases o WHERE o.brand_id = $1 AND o.normalized = a.normalized AND o.model_id <> $2)
+	`, brand.id, sourceID)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE model_aliases SET model_id = $1, brand_id = $2 WHERE model_id = $3`, model.id, brand.id, sourceID)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	result.Repointed[countAliases] += int(n)
+
+	// Det gamla namnet blir ett alias så att nästa import hamnar rätt
+	_, err = tx.Exec(`
+		INSERT INTO model_aliases (model_id, brand_id, alias, normalized)
+		SELECT $1, $2, name, normalized_name FROM models
+		WHERE id = $3 AND normalized_name <> $4
+		ON CONFLICT (brand_id, normalized) DO NOTHING
+	`, model.id, brand.id, sourceID, normalized)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM models WHERE id = $1`, sourceID); err != nil {
+		return err
+	}
+	result.Merged[countModels]++
+	return nil
+}
+
+func mergeMotorcycles(tx *sql.Tx, survivorID int, ids []int, result *MergeResult) error {
+	var modelID int
+	err := tx.QueryRow(`SELECT model_id FROM motorcycles WHERE id = $1 FOR UPDATE`, survivorID).Scan(&modelID)
+	if err == sql.ErrNoRows {
+		return &mergeNotFoundError{"motorcycle", survivorID}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var otherModelID int
+		var name string
+		err := tx.QueryRow(`SELECT model_id, COALESCE(full_name, '') FROM motorcycles WHERE id = $1 FOR UPDATE`, id).
+			Scan(&otherModelID, &name)
+		if err == sql.ErrNoRows {
+			return &mergeNotFoundError{"motorcycle", id}
+		}
+		if err != nil {
+			return err
+		}
+		if otherModelID != modelID {
+			return errMergeModelMismatch
+		}
+		result.MergedNames = append(result.MergedNames, name)
+
+		if err := mergeMotorcycleInto(tx, survivorID, id, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeMotorcycleInto flyttar kopplingarna från sourceID till targetID och tar bort
+// sourceID. Kopplingar som targetID redan har tas bort i stället för att dubbleras.
+func mergeMotorcycleInto(tx *sql.Tx, targetID, sourceID int, result *MergeResult) error {
+	res, err := tx.Exec(`
+		INSERT INTO product_compatibility (product_id, motorcycle_id)
+		SELECT product_id, $1 FROM product_compatibility WHERE motorcycle_id = $2
+		ON CONFLICT DO NOTHING
+	`, targetID, sourceID)
+	if err != nil {
+		return err
+	}
+	moved, _ := res.RowsAffected()
+
+	res, err = tx.Exec(`DELETE FROM product_compatibility WHERE motorcycle_id = $1`, sourceID)
+	if err != nil {
+		return err
+	}
+	total, _ := res.RowsAffected()
+
+	result.Repointed[countFitments] += int(moved)
+	result.Merged[countFitments] += int(total - moved)
+
+	if _, err := tx.Exec(`DELETE FROM motorcycles WHERE id = $1`, sourceID); err != nil {
+		return err
+	}
+	result.Merged[countMotorcycles]++
+	return nil
+}
+
+// recordMerge sparar sammanslagningen i merges för spårbarhet
+func recordMerge(tx *sql.Tx, result *MergeResult) error {
+	repointed, err := json.Marshal(result.Repointed)
+	if err != nil {
+		return err
+	}
+	merged, err := json.Marshal(result.Merged)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, len(result.MergedIDs))
+	for i, id := range result.MergedIDs {
+		ids[i] = int64(id)
+	}
+
+	return tx.QueryRow(`
+		INSERT INTO merges (entity, survivor_id, merged_ids, merged_names, repointed, merged, merged_by)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING id, merged_at
+	`, result.Entity, result.SurvivorID, pq.Array(ids), pq.Array(result.MergedNames),
+		repointed, merged, result.MergedBy).Scan(&result.ID, &result.MergedAt)
+}
+
+// mergeHandler slår ihop posterna i bodyns "ids" med posten i URL:en. Allt görs i en
+// transaktion så att en misslyckad sammanslagning inte lämnar något halvflyttat.
+func mergeHandler(db *sql.DB, entity string, merge mergeFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		survivorID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid "+entity+" id", http.StatusBadRequest)
+			return
+		}
+
+		var body struct {
+			IDs      []int  `json:"ids"`
+			MergedBy string `json:"merged_by"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if len(body.IDs) == 0 {
+			http.Error(w, "ids is required", http.StatusBadRequest)
+			return
+		}
+
+		ids := make([]int, 0, len(body.IDs))
+		seen := map[int]bool{}
+		for _, id := range body.IDs {
+			if id == survivorID {
+				http.Error(w, fmt.Sprintf("Cannot merge %s %d into itself", entity, id), http.StatusBadRequest)
+				return
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result := newMergeResult(entity, survivorID, ids)
+		result.MergedBy = body.MergedBy
+
+		err = merge(tx, survivorID, ids, result)
+		var notFound *mergeNotFoundError
+		switch {
+		case errors.As(err, &notFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err == errMergeBrandMismatch, err == errMergeModelMismatch:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("Error merging %s %v into %d: %v", entity, ids, survivorID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := recordMerge(tx, result); err != nil {
+			log.Printf("Error recording merge: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing merge: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// getMergesHandler listar gjorda sammanslagningar, valfritt filtrerat på entity
+func getMergesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePaging(r, 50, 500)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, entity, survivor_id, merged_ids, merged_names, repointed, merged,
+				COALESCE(merged_by, ''), merged_at
+			FROM merges
+			WHERE $1 = '' OR entity = $1
+			ORDER BY id DESC
+			LIMIT $2 OFFSET $3
+		`, r.URL.Query().Get("entity"), limit, offset)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		merges := []MergeResult{}
+		for rows.Next() {
+			var m MergeResult
+			var ids pq.Int64Array
+			var repointed, merged []byte
+			err := rows.Scan(&m.ID, &m.Entity, &m.SurvivorID, &ids, pq.Array(&m.MergedNames),
+				&repointed, &merged, &m.MergedBy, &m.MergedAt)
+			if err == nil {
+				err = json.Unmarshal(repointed, &m.Repointed)
+			}
+			if err == nil {
+				err = json.Unmarshal(merged, &m.Merged)
+			}
+			if err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			for _, id := range ids {
+				m.MergedIDs = append(m.MergedIDs, int(id))
+			}
+			merges = append(merges, m)
+		}
+
+		json.NewEncoder(w).Encode(merges)
+	}
+}
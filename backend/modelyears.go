@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Gränser för öppna intervall. "2019+" lagras som 2019-9999 och "-2018" som 0-2018.
+const (
+	openStartYear = 0
+	openEndYear   = 9999
+)
+
+// Rimliga årsmodeller för fyrsiffriga år
+const (
+	minModelYear = 1900
+	maxModelYear = 2100
+)
+
+// Tvåsiffriga år upp till och med twoDigitPivot räknas till 2000-talet, övriga till
+// 1900-talet. Gränsen är fast så att samma fil alltid tolkas likadant.
+const twoDigitPivot = 49
+
+// ModelYearError beskriver varför en årsmodell inte gick att tolka
+type ModelYearError struct {
+	Input string
+	// Part är den del av en lista som var fel, tom om hela värdet var fel
+	Part   string
+	Reason string
+}
+
+func (e *ModelYearError) Error() string {
+	if e.Part != "" && e.Part != strings.TrimSpace(e.Input) {
+		return fmt.Sprintf("ogiltig årsmodell %q: %q %s", e.Input, e.Part, e.Reason)
+	}
+	return fmt.Sprintf("ogiltig årsmodell %q: %s", e.Input, e.Reason)
+}
+
+// Bindestreck som leverantörer använder i stället för "-"
+var dashReplacer = strings.NewReplacer(
+	"\u2010", "-", // hyphen
+	"\u2011", "-", // non-breaking hyphen
+	"\u2012", "-", // figure dash
+	"\u2013", "-", // en dash
+	"\u2014", "-", // em dash
+	"\u2015", "-", // horizontal bar
+	"\u2212", "-", // minus sign
+)
+
+// parseModelYears tolkar en årsmodell och returnerar ett intervall per del i listan.
+// Följande former stöds, med fyr- eller tvåsiffriga år och alla sorters bindestreck:
+//
+//	2019                         en årsmodell
+//	2019-2023, 19-23             ett intervall
+//	2019+, >2019, >=2019, 2019-  från och med 2019
+//	-2018, <2018, <=2018         till och med 2018
+//	2017, 2019-2021; 2023        en lista, separerad med komma eller semikolon
+func parseModelYears(modYearStr string) ([]ModelYearRange, error) {
+	normalized := dashReplacer.Replace(modYearStr)
+	parts := strings.FieldsFunc(normalized, func(r rune) bool { return r == ',' || r == ';' })
+	if len(parts) == 0 {
+		return nil, &ModelYearError{Input: modYearStr, Reason: "är tom"}
+	}
+
+	var ranges []ModelYearRange
+	seen := make(map[ModelYearRange]bool)
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		r, reason := parseYearRange(part)
+		if reason != "" {
+			return nil, &ModelYearError{Input: modYearStr, Part: part, Reason: reason}
+		}
+		if !seen[r] {
+			seen[r] = true
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, nil
+}
+
+// parseYearRange tolkar en del av listan. Vid fel returneras en förklaring
+func parseYearRange(s string) (ModelYearRange, string) {
+	s = strings.Join(strings.Fields(s), "")
+	if s == "" {
+		return ModelYearRange{}, "tom del i listan"
+	}
+
+	var from, to string
+	switch {
+	case strings.HasPrefix(s, ">="):
+		from, to = s[2:], ""
+	case strings.HasPrefix(s, ">"):
+		from, to = s[1:], ""
+	case strings.HasPrefix(s, "<="):
+		from, to = "", s[2:]
+	case strings.HasPrefix(s, "<"):
+		from, to = "", s[1:]
+	case strings.HasSuffix(s, "+"):
+		from, to = strings.TrimSuffix(s, "+"), ""
+	case strings.Count(s, "-") == 1:
+		from, to, _ = strings.Cut(s, "-")
+	case strings.Contains(s, "-"):
+		return ModelYearRange{}, "har för många bindestreck"
+	default:
+		y, reason := parseYear(s)
+		if reason != "" {
+			return ModelYearRange{}, reason
+		}
+		return ModelYearRange{StartYear: y, EndYear: y}, ""
+	}
+
+	if from == "" && to == "" {
+		return ModelYearRange{}, "saknar år"
+	}
+
+	r := ModelYearRange{StartYear: openStartYear, EndYear: openEndYear}
+	var reason string
+	if from != "" {
+		if r.StartYear, reason = parseYear(from); reason != "" {
+			return r, reason
+		}
+	}
+	if to != "" {
+		if r.EndYear, reason = parseYear(to); reason != "" {
+			return r, reason
+		}
+	}
+	if r.StartYear > r.EndYear {
+		return r, fmt.Sprintf("startåret %d är efter slutåret %d", r.StartYear, r.EndYear)
+	}
+	return r, ""
+}
+
+// parseYear tolkar ett fyr- eller tvåsiffrigt år. Tvåsiffriga år tolkas enligt
+// twoDigitPivot ("23" → 2023, "98" → 1998).
+func parseYear(s string) (int, string) {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0, fmt.Sprintf("%q är inget år", s)
+		}
+	}
+
+	y, _ := strconv.Atoi(s)
+	switch len(s) {
+	case 2:
+		if y <= twoDigitPivot {
+			return 2000 + y, ""
+		}
+		return 1900 + y, ""
+	case 4:
+		if y < minModelYear || y > maxModelYear {
+			return 0, fmt.Sprintf("%d är utanför %d-%d", y, minModelYear, maxModelYear)
+		}
+		return y, ""
+	}
+	return 0, fmt.Sprintf("%q är inget år", s)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModelYears(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []ModelYearRange
+	}{
+		{"2019", []ModelYearRange{{2019, 2019}}},
+		{"2019-2023", []ModelYearRange{{2019, 2023}}},
+		{"19-23", []ModelYearRange{{2019, 2023}}},
+		{"2019 – 2023", []ModelYearRange{{2019, 2023}}},
+		{"2019+", []ModelYearRange{{2019, openEndYear}}},
+		{">=2019", []ModelYearRange{{2019, openEndYear}}},
+		{"2019-", []ModelYearRange{{2019, openEndYear}}},
+		{"-2018", []ModelYearRange{{openStartYear, 2018}}},
+		{"<2018", []ModelYearRange{{openStartYear, 2018}}},
+		{"2017, 2019-2021; 2023", []ModelYearRange{{2017, 2017}, {2019, 2021}, {2023, 2023}}},
+		{"2019, 2019", []ModelYearRange{{2019, 2019}}},
+		// Tvåsiffriga år beror inte på dagens datum
+		{"00", []ModelYearRange{{2000, 2000}}},
+		{"49", []ModelYearRange{{2049, 2049}}},
+		{"50", []ModelYearRange{{1950, 1950}}},
+		{"98-02", []ModelYearRange{{1998, 2002}}},
+	}
+	for _, tt := range tests {
+		got, err := parseModelYears(tt.in)
+		if err != nil {
+			t.Errorf("parseModelYears(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseModelYears(%q) = %v, vill ha %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseModelYearsInvalid(t *testing.T) {
+	for _, in := range []string{"", " , ", "abc", "2019-2020-2021", "2023-2019", "1899", "2019x", "+", "201"} {
+		if got, err := parseModelYears(in); err == nil {
+			t.Errorf("parseModelYears(%q) = %v, vill ha ett fel", in, got)
+		}
+	}
+}
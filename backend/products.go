@@ -0,0 +1,448 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Största längder enligt kolumnerna i products
+const (
+	maxProductIDLength    = 50
+	maxProductNameLength  = 200
+	maxForBrandLength     = 100
+	maxImporterNameLength = 100
+)
+
+// Produkt-id:n består av bokstäver, siffror, bindestreck, understreck och punkter,
+// t.ex. "KT1234" eller "SP-450.12"
+var productIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// productInput är bodyn för att skapa och ändra en produkt. Fälten är pekare så att
+// PATCH kan skilja på ett fält som saknas och ett som är tomt.
+type productInput struct {
+	ID           *string `json:"id"`
+	Name         *string `json:"name"`
+	CategoryID   *int    `json:"category_id"`
+	Description  *string `json:"description"`
+	ForBrand     *string `json:"for_brand"`
+	IsUniversal  *bool   `json:"is_universal"`
+	ImporterName *string `json:"importer_name"`
+}
+
+// apply lägger in de fält som finns i bodyn i p
+func (in productInput) apply(p *Product) {
+	if in.Name != nil {
+		p.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.CategoryID != nil {
+		p.CategoryID = *in.CategoryID
+	}
+	if in.Description != nil {
+		p.Description = *in.Description
+	}
+	if in.ForBrand != nil {
+		p.ForBrand = strings.TrimSpace(*in.ForBrand)
+	}
+	if in.IsUniversal != nil {
+		p.IsUniversal = *in.IsUniversal
+	}
+	if in.ImporterName != nil {
+		p.ImporterName = strings.TrimSpace(*in.ImporterName)
+	}
+}
+
+// validateProductID kontrollerar id:t för en ny produkt
+func validateProductID(id string) error {
+	if id == "" {
+		return errors.New("id is required")
+	}
+	if len(id) > maxProductIDLength {
+		return fmt.Errorf("id can be at most %d characters", maxProductIDLength)
+	}
+	if !productIDPattern.MatchString(id) {
+		return errors.New("id may only contain letters, digits, '-', '_' and '.'")
+	}
+	return nil
+}
+
+// validateProduct kontrollerar fälten mot kolumnerna i products
+func validateProduct(p Product) error {
+	if p.Name == "" {
+		return errors.New("name is required")
+	}
+	if utf8.RuneCountInString(p.Name) > maxProductNameLength {
+		return fmt.Errorf("name can be at most %d characters", maxProductNameLength)
+	}
+	if p.CategoryID == 0 {
+		return errors.New("category_id is required")
+	}
+	if utf8.RuneCountInString(p.ForBrand) > maxForBrandLength {
+		return fmt.Errorf("for_brand can be at most %d characters", maxForBrandLength)
+	}
+	if utf8.RuneCountInString(p.ImporterName) > maxImporterNameLength {
+		return fmt.Errorf("importer_name can be at most %d characters", maxImporterNameLength)
+	}
+	return nil
+}
+
+func categoryExists(q queryer, id int) (bool, error) {
+	var exists bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM categories WHERE id = $1)`, id).Scan(&exists)
+	return exists, err
+}
+
+// getProduct hämtar en produkt med kategori och motorcyklar. Till skillnad från
+// /products visas även utgångna produkter.
+func getProduct(db *sql.DB, id string) (Product, error) {
+	var p Product
+	err := db.QueryRow(`
+		SELECT p.id, p.name, p.category_id, c.name,
+			COALESCE((
+				SELECT string_agg(a.name, '/' ORDER BY a.level)
+				FROM categories a
+				WHERE c.path LIKE a.path || '%'
+			), c.name),
+			COALESCE(p.description, ''), COALESCE(p.for_brand, ''), COALESCE(p.is_universal, false),
+			COALESCE(p.importer_name, ''), p.discontinued_at,
+			(SELECT COUNT(*) FROM product_compatibility pc WHERE pc.product_id = p.id)
+		FROM products p
+		JOIN categories c ON c.id = p.category_id
+		WHERE p.id = $1
+	`, id).Scan(&p.ID, &p.Name, &p.CategoryID, &p.CategoryName, &p.CategoryPath,
+		&p.Description, &p.ForBrand, &p.IsUniversal, &p.ImporterName, &p.DiscontinuedAt, &p.FitmentCount)
+	if err != nil {
+		return p, err
+	}
+
+	p.FitType = fitType(p, false)
+	p.Motorcycles, err = productFitments(db, p.ID, -1, 0)
+	return p, err
+}
+
+// writeProduct hämtar produkten på nytt och svarar med den
+func writeProduct(w http.ResponseWriter, db *sql.DB, id string, status int) {
+	p, err := getProduct(db, id)
+	if err != nil {
+		log.Printf("Error fetching product %s: %v", id, err)
+		http.Error(w, "Database query error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func getProductHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := getProduct(db, mux.Vars(r)["id"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// createProductHandler skapar en produkt. Id:t tas från URL:en (POST /products/{id})
+// eller från bodyn (POST /products).
+func createProductHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var in productInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+
+		id, inPath := mux.Vars(r)["id"]
+		if !inPath && in.ID != nil {
+			id = strings.TrimSpace(*in.ID)
+		}
+		if inPath && in.ID != nil && *in.ID != id {
+			http.Error(w, "Invalid product: id in body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		if err := validateProductID(id); err != nil {
+			http.Error(w, "Invalid product: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p := Product{ID: id}
+		in.apply(&p)
+		if err := validateProduct(p); err != nil {
+			http.Error(w, "Invalid product: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, err := categoryExists(db, p.CategoryID); err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, fmt.Sprintf("Invalid product: category %d does not exist", p.CategoryID), http.StatusBadRequest)
+			return
+		}
+
+		res, err := db.Exec(`
+			INSERT INTO products (id, name, category_id, description, for_brand, is_universal, importer_name, edited_at)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), now())
+			ON CONFLICT (id) DO NOTHING
+		`, p.ID, p.Name, p.CategoryID, p.Description, p.ForBrand, p.IsUniversal, p.ImporterName)
+		if err != nil {
+			log.Printf("Error creating product: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, fmt.Sprintf("Product %s already exists", p.ID), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Location", "/products/"+p.ID)
+		writeProduct(w, db, p.ID, http.StatusCreated)
+	}
+}
+
+// updateProductHandler ersätter produkten vid PUT och ändrar bara de fält som finns i
+// bodyn vid PATCH. Id:t kan inte ändras.
+func updateProductHandler(db *sql.DB, partial bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		var in productInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if in.ID != nil && *in.ID != id {
+			http.Error(w, "Invalid product: id cannot be changed", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		p := Product{ID: id}
+		err = tx.QueryRow(`
+			SELECT name, category_id, COALESCE(description, ''), COALESCE(for_brand, ''),
+				COALESCE(is_universal, false), COALESCE(importer_name, '')
+			FROM products WHERE id = $1
+			FOR UPDATE
+		`, id).Scan(&p.Name, &p.CategoryID, &p.Description, &p.ForBrand, &p.IsUniversal, &p.ImporterName)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		// PUT ersätter hela produkten, så fält som saknas får sina standardvärden
+		if !partial {
+			p = Product{ID: id}
+		}
+		in.apply(&p)
+		if err := validateProduct(p); err != nil {
+			http.Error(w, "Invalid product: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, err := categoryExists(tx, p.CategoryID); err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, fmt.Sprintf("Invalid product: category %d does not exist", p.CategoryID), http.StatusBadRequest)
+			return
+		}
+
+		_, err = tx.Exec(`
+			UPDATE products
+			SET name = $1, category_id = $2, description = $3, for_brand = NULLIF($4, ''),
+				is_universal = $5, importer_name = NULLIF($6, ''), edited_at = now()
+			WHERE id = $7
+		`, p.Name, p.CategoryID, p.Description, p.ForBrand, p.IsUniversal, p.ImporterName, id)
+		if err != nil {
+			log.Printf("Error updating product %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing product %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		writeProduct(w, db, id, http.StatusOK)
+	}
+}
+
+// deleteProductHandler tar bort produkten och dess kopplingar
+func deleteProductHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`DELETE FROM product_compatibility WHERE product_id = $1`, id); err != nil {
+			log.Printf("Error deleting fitments of product %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		res, err := tx.Exec(`DELETE FROM products WHERE id = $1`, id)
+		if err != nil {
+			log.Printf("Error deleting product %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing delete of product %s: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Kolumnerna som /products kan sorteras på. Uttrycken får inte vara NULL, eftersom
+// de jämförs med markörens värde. Uttrycket för relevance beror på q och sätts av
+// getFilteredProductsHandler.
+var productSortColumns = map[string]string{
+	"name":      "p.name",
+	"id":        "p.id",
+	"category":  "COALESCE(cp.full_category_path, '')",
+	"importer":  "COALESCE(p.importer_name, '')",
+	"relevance": "",
+}
+
+// productSearchQuery är q tolkad med både svensk och engelsk ordstamning.
+// %d är parameterns position.
+const productSearchQuery = "(websearch_to_tsquery('swedish', $%d) || websearch_to_tsquery('english', $%d))"
+
+// productRelevance rankar en träff mot productSearchQuery. Den avrundas så att värdet
+// i markören går att jämföra exakt.
+const productRelevance = "round(ts_rank(p.search_vector, %s)::numeric, 6)"
+
+// productSort är sorteringen för /products. p.id används alltid som andra nyckel så att
+// ordningen är entydig.
+type productSort struct {
+	name  string
+	expr  string
+	order string // ASC eller DESC
+}
+
+// parseProductSort tolkar sort och order. Med q sorteras det på relevans, mest
+// relevant först, om inget annat anges.
+func parseProductSort(sort, order string, search bool) (productSort, error) {
+	if sort == "" {
+		sort = "name"
+		if search {
+			sort = "relevance"
+		}
+	}
+	expr, ok := productSortColumns[sort]
+	if !ok {
+		return productSort{}, errors.New("sort must be relevance, name, id, category or importer")
+	}
+	if sort == "relevance" && !search {
+		return productSort{}, errors.New("sort=relevance requires q")
+	}
+
+	switch strings.ToLower(order) {
+	case "":
+		order = "ASC"
+		if sort == "relevance" {
+			order = "DESC"
+		}
+	case "asc":
+		order = "ASC"
+	case "desc":
+		order = "DESC"
+	default:
+		return productSort{}, errors.New("order must be asc or desc")
+	}
+	return productSort{name: sort, expr: expr, order: order}, nil
+}
+
+// after är jämförelsen för rader som kommer efter markören
+func (s productSort) after() string {
+	if s.order == "DESC" {
+		return "<"
+	}
+	return ">"
+}
+
+// value är produktens värde för sorteringskolumnen
+func (s productSort) value(p Product) string {
+	switch s.name {
+	case "id":
+		return p.ID
+	case "category":
+		return p.CategoryPath
+	case "importer":
+		return p.ImporterName
+	case "relevance":
+		return strconv.FormatFloat(p.Relevance, 'f', -1, 64)
+	}
+	return p.Name
+}
+
+// productCursor pekar på den sista produkten på en sida. Sorteringen följer med så att
+// en markör inte kan användas med en annan sortering.
+type productCursor struct {
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+	Value string `json:"value"`
+	ID    string `json:"id"`
+}
+
+func encodeProductCursor(s productSort, last Product) string {
+	b, _ := json.Marshal(productCursor{Sort: s.name, Order: s.order, Value: s.value(last), ID: last.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeProductCursor(v string, s productSort) (*productCursor, error) {
+	var c productCursor
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	if c.Sort != s.name || c.Order != s.order {
+		return nil, errors.New("cursor was created with another sort or order")
+	}
+	return &c, nil
+}
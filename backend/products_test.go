@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProductSort(t *testing.T) {
+	tests := []struct {
+		sort, order string
+		search      bool
+		wantName    string
+		wantOrder   string
+		wantErr     bool
+	}{
+		{"", "", false, "name", "ASC", false},
+		{"", "", true, "relevance", "DESC", false},
+		{"", "asc", true, "relevance", "ASC", false},
+		{"name", "", true, "name", "ASC", false},
+		{"id", "desc", false, "id", "DESC", false},
+		{"category", "DESC", false, "category", "DESC", false},
+		{"importer", "Asc", false, "importer", "ASC", false},
+		{"relevance", "", false, "", "", true},
+		{"price", "", false, "", "", true},
+		{"NAME", "", false, "", "", true},
+		{"name", "up", false, "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseProductSort(tt.sort, tt.order, tt.search)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseProductSort(%q, %q, %t): fel = %v, vill ha fel: %t", tt.sort, tt.order, tt.search, err, tt.wantErr)
+			continue
+		}
+		if got.name != tt.wantName || got.order != tt.wantOrder {
+			t.Errorf("parseProductSort(%q, %q, %t) = %s %s, vill ha %s %s",
+				tt.sort, tt.order, tt.search, got.name, got.order, tt.wantName, tt.wantOrder)
+		}
+		if !tt.wantErr && tt.sort != "relevance" && got.expr != productSortColumns[got.name] {
+			t.Errorf("parseProductSort(%q, %q, %t): expr = %q", tt.sort, tt.order, tt.search, got.expr)
+		}
+	}
+}
+
+// En markör ska gå att avkoda till samma sortering, värde och id som den skapades med,
+// men bara med samma sortering
+func TestProductCursor(t *testing.T) {
+	last := Product{
+		ID:           "KT1234",
+		Name:         "Fjäder, bak \"lång\"",
+		CategoryPath: "fjädrar/Bakfjädrar",
+		ImporterName: "Testimportören",
+		Relevance:    0.123456,
+	}
+	tests := []struct {
+		sort, order string
+		search      bool
+		wantValue   string
+	}{
+		{"name", "asc", false, last.Name},
+		{"id", "desc", false, last.ID},
+		{"category", "asc", false, last.CategoryPath},
+		{"importer", "desc", false, last.ImporterName},
+		{"relevance", "", true, "0.123456"},
+	}
+	for _, tt := range tests {
+		s, err := parseProductSort(tt.sort, tt.order, tt.search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := decodeProductCursor(encodeProductCursor(s, last), s)
+		if err != nil {
+			t.Errorf("sort=%s: %v", tt.sort, err)
+			continue
+		}
+		want := productCursor{Sort: s.name, Order: s.order, Value: tt.wantValue, ID: last.ID}
+		if *c != want {
+			t.Errorf("sort=%s: markören = %+v, vill ha %+v", tt.sort, *c, want)
+		}
+	}
+
+	byName, _ := parseProductSort("name", "asc", false)
+	byNameDesc, _ := parseProductSort("name", "desc", false)
+	byID, _ := parseProductSort("id", "asc", false)
+	cursor := encodeProductCursor(byName, last)
+	invalid := []struct {
+		name, cursor string
+		sort         productSort
+	}{
+		{"annan ordning", cursor, byNameDesc},
+		{"annan kolumn", cursor, byID},
+		{"inte base64", "!!!", byName},
+		{"inte json", base64.RawURLEncoding.EncodeToString([]byte("name")), byName},
+	}
+	for _, tt := range invalid {
+		if _, err := decodeProductCursor(tt.cursor, tt.sort); err == nil {
+			t.Errorf("%s: markören godtogs", tt.name)
+		}
+	}
+}
+
+// Stegen körs i ordning mot samma databas, så senare steg ser tidigare ändringar
+func TestProductCRUDValidation(t *testing.T) {
+	db := testDB(t)
+
+	rootID, _, err := getOrCreateCategoryWithParent(db, "fjädrar", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	categoryID, _, err := getOrCreateCategoryWithParent(db, "Bakfjädrar", &rootID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	product := func(id, name string) string {
+		return fmt.Sprintf(`{"id": %q, "name": %q, "category_id": %d}`, id, name, categoryID)
+	}
+
+	create := createProductHandler(db)
+	steps := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		id      string // id i URL:en
+		body    string
+		want    int
+	}{
+		{"skapa", create, http.MethodPost, "", product("KT1", "Fjäder"), http.StatusCreated},
+		{"skapa igen", create, http.MethodPost, "", product("KT1", "Fjäder"), http.StatusConflict},
+		{"skapa med id i URL:en", create, http.MethodPost, "KT2", `{"name": "Dämpare", "category_id": ` + fmt.Sprint(categoryID) + `}`, http.StatusCreated},
+		{"olika id i URL och body", create, http.MethodPost, "KT3", product("KT4", "Länk"), http.StatusBadRequest},
+		{"id saknas", create, http.MethodPost, "", `{"name": "Länk", "category_id": ` + fmt.Sprint(categoryID) + `}`, http.StatusBadRequest},
+		{"ogiltiga tecken i id", create, http.MethodPost, "", product("KT 3", "Länk"), http.StatusBadRequest},
+		{"för långt id", create, http.MethodPost, "", product(strings.Repeat("K", maxProductIDLength+1), "Länk"), http.StatusBadRequest},
+		{"namn saknas", create, http.MethodPost, "", product("KT3", " "), http.StatusBadRequest},
+		{"för långt namn", create, http.MethodPost, "", product("KT3", strings.Repeat("ä", maxProductNameLength+1)), http.StatusBadRequest},
+		{"kategori saknas", create, http.MethodPost, "", `{"id": "KT3", "name": "Länk"}`, http.StatusBadRequest},
+		{"okänd kategori", create, http.MethodPost, "", `{"id": "KT3", "name": "Länk", "category_id": 999999}`, http.StatusBadRequest},
+		{"för långt for_brand", create, http.MethodPost, "",
+			fmt.Sprintf(`{"id": "KT3", "name": "Länk", "category_id": %d, "for_brand": %q}`, categoryID, strings.Repeat("x", maxForBrandLength+1)),
+			http.StatusBadRequest},
+		{"ogiltig JSON", create, http.MethodPost, "", `{"id": "KT3"`, http.StatusBadRequest},
+
+		{"hämta", getProductHandler(db), http.MethodGet, "KT1", "", http.StatusOK},
+		{"hämta okänd", getProductHandler(db), http.MethodGet, "KT404", "", http.StatusNotFound},
+
+		{"byta id", updateProductHandler(db, false), http.MethodPut, "KT1", product("KT9", "Fjäder"), http.StatusBadRequest},
+		{"PUT utan kategori", updateProductHandler(db, false), http.MethodPut, "KT1", `{"name": "Fjäder, ny"}`, http.StatusBadRequest},
+		{"PUT", updateProductHandler(db, false), http.MethodPut, "KT1", product("KT1", "Fjäder, ny"), http.StatusOK},
+		{"PUT okänd", updateProductHandler(db, false), http.MethodPut, "KT404", product("KT404", "Fjäder"), http.StatusNotFound},
+		{"PATCH", updateProductHandler(db, true), http.MethodPatch, "KT2", `{"name": "Dämpare, ny"}`, http.StatusOK},
+		{"PATCH med tomt namn", updateProductHandler(db, true), http.MethodPatch, "KT2", `{"name": ""}`, http.StatusBadRequest},
+		{"PATCH med okänd kategori", updateProductHandler(db, true), http.MethodPatch, "KT2", `{"category_id": 999999}`, http.StatusBadRequest},
+
+		{"ta bort", deleteProductHandler(db), http.MethodDelete, "KT1", "", http.StatusNoContent},
+		{"ta bort igen", deleteProductHandler(db), http.MethodDelete, "KT1", "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		target, vars := "/products", map[string]string{}
+		if step.id != "" {
+			target += "/" + step.id
+			vars["id"] = step.id
+		}
+		rec := callHandler(step.handler, step.method, target, step.body, vars)
+		if rec.Code != step.want {
+			t.Errorf("%s: %s %s gav %d %s, vill ha %d", step.name, step.method, target, rec.Code, rec.Body, step.want)
+		}
+	}
+
+	// Bara det som lyckades ska ha ändrat något
+	rows, err := db.Query(`SELECT id, name FROM products ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id+": "+name)
+	}
+	if want := []string{"KT2: Dämpare, ny"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("produkter = %q, vill ha %q", got, want)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/encoding"
+)
+
+const defaultProfileName = "default"
+
+// columnMapping håller de uppslagna kolumnindexen för en profil
+type columnMapping struct {
+	category    int
+	brand       int
+	model       int
+	years       int
+	productCode int
+	productName int
+	importer    int
+}
+
+// maxIndex returnerar det högsta kolumnindexet som en rad måste innehålla
+func (c columnMapping) maxIndex() int {
+	max := 0
+	for _, idx := range []int{c.category, c.brand, c.model, c.years, c.productCode, c.productName, c.importer} {
+		if idx > max {
+			max = idx
+		}
+	}
+	return max
+}
+
+// resolveColumns översätter profilens kolumner (namn eller index) till index i headerraden
+func (p ImportProfile) resolveColumns(header []string) (columnMapping, error) {
+	var cols columnMapping
+	var err error
+
+	specs := []struct {
+		field string
+		spec  string
+		dst   *int
+	}{
+		{"category_column", p.CategoryColumn, &cols.category},
+		{"brand_column", p.BrandColumn, &cols.brand},
+		{"model_column", p.ModelColumn, &cols.model},
+		{"years_column", p.YearsColumn, &cols.years},
+		{"product_code_column", p.ProductCodeColumn, &cols.productCode},
+		{"product_name_column", p.ProductNameColumn, &cols.productName},
+		{"importer_column", p.ImporterColumn, &cols.importer},
+	}
+
+	for _, s := range specs {
+		*s.dst, err = resolveColumn(header, s.spec)
+		if err != nil {
+			return cols, fmt.Errorf("%s: %w", s.field, err)
+		}
+	}
+	return cols, nil
+}
+
+func resolveColumn(header []string, spec string) (int, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0, fmt.Errorf("kolumn saknas i profilen")
+	}
+
+	if idx, err := strconv.Atoi(spec); err == nil {
+		if idx < 0 {
+			return 0, fmt.Errorf("ogiltigt kolumnindex %d", idx)
+		}
+		return idx, nil
+	}
+
+	for i, name := range header {
+		name = strings.TrimPrefix(name, "\ufeff")
+		if strings.EqualFold(strings.TrimSpace(name), spec) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("kolumnen %q finns inte i filen", spec)
+}
+
+// delimiterRune returnerar profilens avgränsare som rune
+func (p ImportProfile) delimiterRune() (rune, error) {
+	return parseDelimiter(p.Delimiter)
+}
+
+// textEncoding slår upp profilens teckenkodning, t.ex. "windows-1252" eller "utf-8"
+func (p ImportProfile) textEncoding() (encoding.Encoding, error) {
+	return lookupEncoding(p.Encoding)
+}
+
+func (p ImportProfile) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	// "auto" betyder att avgränsare respektive kodning hittas i varje fil
+	if !isAutoDetect(p.Delimiter) {
+		if _, err := p.delimiterRune(); err != nil {
+			return err
+		}
+	}
+	if !isAutoDetect(p.Encoding) {
+		if _, err := p.textEncoding(); err != nil {
+			return err
+		}
+	}
+	for field, spec := range map[string]string{
+		"category_column":     p.CategoryColumn,
+		"brand_column":        p.BrandColumn,
+		"model_column":        p.ModelColumn,
+		"years_column":        p.YearsColumn,
+		"product_code_column": p.ProductCodeColumn,
+		"product_name_column": p.ProductNameColumn,
+		"importer_column":     p.ImporterColumn,
+	} {
+		if strings.TrimSpace(spec) == "" {
+			return fmt.Errorf("%s is required", field)
+		}
+	}
+	return nil
+}
+
+func getImportProfile(db *sql.DB, name string) (ImportProfile, error) {
+	var p ImportProfile
+	err := db.QueryRow(`
+		SELECT id, name, category_column, brand_column, model_column, years_column,
+			product_code_column, product_name_column, importer_column, code_prefix, delimiter, encoding
+		FROM import_profiles
+		WHERE name = $1
+	`, name).Scan(&p.ID, &p.Name, &p.CategoryColumn, &p.BrandColumn, &p.ModelColumn, &p.YearsColumn,
+		&p.ProductCodeColumn, &p.ProductNameColumn, &p.ImporterColumn, &p.CodePrefix, &p.Delimiter, &p.Encoding)
+	return p, err
+}
+
+func getImportProfilesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query(`
+			SELECT id, name, category_column, brand_column, model_column, years_column,
+				product_code_column, product_name_column, importer_column, code_prefix, delimiter, encoding
+			FROM import_profiles
+			ORDER BY name
+		`)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var profiles []ImportProfile
+		for rows.Next() {
+			var p ImportProfile
+			if err := rows.Scan(&p.ID, &p.Name, &p.CategoryColumn, &p.BrandColumn, &p.ModelColumn, &p.YearsColumn,
+				&p.ProductCodeColumn, &p.ProductNameColumn, &p.ImporterColumn, &p.CodePrefix, &p.Delimiter, &p.Encoding); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			profiles = append(profiles, p)
+		}
+
+		json.NewEncoder(w).Encode(profiles)
+	}
+}
+
+func getImportProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := getImportProfile(db, mux.Vars(r)["name"])
+		if err == sql.ErrNoRows {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// saveImportProfileHandler skapar en profil eller uppdaterar en befintlig med samma namn
+func saveImportProfileHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p ImportProfile
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if p.Delimiter == "" {
+			p.Delimiter = autoDetect
+		}
+		if p.Encoding == "" {
+			p.Encoding = autoDetect
+		}
+		if err := p.validate(); err != nil {
+			http.Error(w, "Invalid profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err := db.QueryRow(`
+			INSERT INTO import_profiles (name, category_column, brand_column, model_column, years_column,
+				product_code_column, product_name_column, importer_column, code_prefix, delimiter, encoding)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT (name) DO UPDATE SET
+				category_column = EXCLUDED.category_column,
+				brand_column = EXCLUDED.brand_column,
+				model_column = EXCLUDED.model_column,
+				years_column = EXCLUDED.years_column,
+				product_code_column = EXCLUDED.product_code_column,
+				product_name_column = EXCLUDED.product_name_column,
+				importer_column = EXCLUDED.importer_column,
+				code_prefix = EXCLUDED.code_prefix,
+				delimiter = EXCLUDED.delimiter,
+				encoding = EXCLUDED.encoding
+			RETURNING id
+		`, p.Name, p.CategoryColumn, p.BrandColumn, p.ModelColumn, p.YearsColumn,
+			p.ProductCodeColumn, p.ProductNameColumn, p.ImporterColumn, p.CodePrefix, p.Delimiter, p.Encoding).Scan(&p.ID)
+		if err != nil {
+			log.Printf("Error saving import profile: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+	}
+}
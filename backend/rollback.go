@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Entiteter och åtgärder i import_changes
+const (
+	changeCategory   = "category"
+	changeBrand      = "brand"
+	changeModel      = "model"
+	changeMotorcycle = "motorcycle"
+	changeProduct    = "product"
+	changeFitment    = "fitment"
+
+	changeCreated = "created"
+	changeUpdated = "updated"
+)
+
+// importChange är en ändring som en import gjorde och som en rollback måste återställa.
+// För fitments är entityID produkten och relatedID motorcykeln.
+type importChange struct {
+	id        int
+	entity    string
+	action    string
+	entityID  string
+	relatedID int
+	previous  any
+}
+
+var errNotRollbackable = errors.New("only succeeded imports can be rolled back")
+
+// rollbackConflictError returneras när något som importen skapade används av annat
+type rollbackConflictError struct {
+	conflicts []RollbackConflict
+}
+
+func (e *rollbackConflictError) Error() string {
+	return fmt.Sprintf("%d rollback conflicts", len(e.conflicts))
+}
+
+func recordImportChange(q queryer, importID int, c importChange) error {
+	var previous []byte
+	if c.previous != nil {
+		var err error
+		previous, err = json.Marshal(c.previous)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO import_changes (import_id, entity, action, entity_id, related_id, previous)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6)
+	`, importID, c.entity, c.action, c.entityID, c.relatedID, previous)
+	return err
+}
+
+// rollbackImport återställer alla ändringar som importen gjorde, i omvänd ordning
+func rollbackImport(tx *sql.Tx, importID int) (*RollbackResult, error) {
+	var state string
+	err := tx.QueryRow(`SELECT state FROM imports WHERE id = $1 FOR UPDATE`, importID).Scan(&state)
+	if err != nil {
+		return nil, err
+	}
+	if state != jobSucceeded {
+		return nil, errNotRollbackable
+	}
+
+	// Produkter som senare importer har använt kan inte tas bort eller återställas
+	rows, err := tx.Query(`
+		SELECT DISTINCT c.entity_id, li.id
+		FROM import_changes c
+		JOIN import_rows lr ON lr.product_id = c.entity_id AND lr.import_id > c.import_id
+		JOIN imports li ON li.id = lr.import_id AND li.state = $2
+		WHERE c.import_id = $1 AND c.entity IN ($3, $4)
+		ORDER BY c.entity_id, li.id
+	`, importID, jobSucceeded, changeProduct, changeFitment)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []RollbackConflict
+	for rows.Next() {
+		var productID string
+		var laterID int
+		if err := rows.Scan(&productID, &laterID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conflicts = append(conflicts, RollbackConflict{
+			Entity: changeProduct,
+			ID:     productID,
+			Reason: fmt.Sprintf("used by later import %d", laterID),
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Produkter som har ändrats för hand sedan importen startade skulle skrivas över
+	rows, err = tx.Query(`
+		SELECT DISTINCT c.entity_id
+		FROM import_changes c
+		JOIN imports i ON i.id = c.import_id
+		JOIN products p ON p.id = c.entity_id
+		WHERE c.import_id = $1 AND c.entity IN ($2, $3) AND p.edited_at >= i.started_at
+		ORDER BY c.entity_id
+	`, importID, changeProduct, changeFitment)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var productID string
+		if err := rows.Scan(&productID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conflicts = append(conflicts, RollbackConflict{
+			Entity: changeProduct,
+			ID:     productID,
+			Reason: "edited after the import",
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, &rollbackConflictError{conflicts: conflicts}
+	}
+
+	changes, err := getImportChanges(tx, importID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RollbackResult{ImportID: importID, Reverted: map[string]int{}}
+	for _, c := range changes {
+		reverted, err := revertImportChange(tx, c)
+		if err != nil {
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+				// foreign_key_violation: något som inte kom från importen refererar raden
+				return nil, &rollbackConflictError{conflicts: []RollbackConflict{{
+					Entity: c.entity,
+					ID:     c.entityID,
+					Reason: "still referenced: " + pqErr.Detail,
+				}}}
+			}
+			return nil, fmt.Errorf("kunde inte återställa %s %s: %w", c.entity, c.entityID, err)
+		}
+		if reverted {
+			result.Reverted[c.entity]++
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE imports SET state = $1, rolled_back_at = now() WHERE id = $2`, jobRolledBack, importID)
+	if err != nil {
+		return nil, err
+	}
+	result.State = jobRolledBack
+	return result, nil
+}
+
+// getImportChanges hämtar importens ändringar med den senaste först
+func getImportChanges(q queryer, importID int) ([]importChange, error) {
+	rows, err := q.Query(`
+		SELECT id, entity, action, entity_id, COALESCE(related_id, 0), previous
+		FROM import_changes
+		WHERE import_id = $1
+		ORDER BY id DESC
+	`, importID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []importChange
+	for rows.Next() {
+		var c importChange
+		var previous []byte
+		if err := rows.Scan(&c.id, &c.entity, &c.action, &c.entityID, &c.relatedID, &previous); err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			c.previous = json.RawMessage(previous)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// revertImportChange ångrar en ändring och returnerar om något faktiskt ändrades
+func revertImportChange(q queryer, c importChange) (bool, error) {
+	var res sql.Result
+	var err error
+
+	switch {
+	case c.entity == changeFitment && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM product_compatibility WHERE product_id = $1 AND motorcycle_id = $2`, c.entityID, c.relatedID)
+	case c.entity == changeProduct && c.action == changeUpdated:
+		raw, ok := c.previous.(json.RawMessage)
+		if !ok {
+			return false, fmt.Errorf("tidigare värden saknas")
+		}
+		var prev productState
+		if err := json.Unmarshal(raw, &prev); err != nil {
+			return false, err
+		}
+		res, err = q.Exec(`UPDATE products SET name = $1, is_universal = $2, discontinued_at = $3 WHERE id = $4`,
+			prev.Name, prev.IsUniversal, prev.DiscontinuedAt, c.entityID)
+	case c.entity == changeProduct && c.action == changeDiscontinued:
+		res, err = q.Exec(`UPDATE products SET discontinued_at = NULL WHERE id = $1`, c.entityID)
+	case c.entity == changeFitment && c.action == changeDeleted:
+		res, err = q.Exec(`
+			INSERT INTO product_compatibility (product_id, motorcycle_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, c.entityID, c.relatedID)
+	case c.entity == changeProduct && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM products WHERE id = $1`, c.entityID)
+	case c.entity == changeMotorcycle && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM motorcycles WHERE id = $1`, c.entityID)
+	case c.entity == changeModel && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM models WHERE id = $1`, c.entityID)
+	case c.entity == changeBrand && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM brands WHERE id = $1`, c.entityID)
+	case c.entity == changeCategory && c.action == changeCreated:
+		res, err = q.Exec(`DELETE FROM categories WHERE id = $1`, c.entityID)
+	default:
+		return false, fmt.Errorf("okänd ändring %s/%s", c.entity, c.action)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func rollbackImportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid import id", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := rollbackImport(tx, id)
+
+		var conflictErr *rollbackConflictError
+		switch {
+		case err == sql.ErrNoRows:
+			http.Error(w, "Import not found", http.StatusNotFound)
+			return
+		case err == errNotRollbackable:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.As(err, &conflictErr):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(RollbackFailure{
+				Error:     "the import cannot be rolled back because later data depends on it",
+				Conflicts: conflictErr.conflicts,
+			})
+			return
+		case err != nil:
+			log.Printf("Error rolling back import %d: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing rollback of import %d: %v", id, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// En produkt som har ändrats via API:t efter importen får inte skrivas över av en
+// rollback, så rollbacken ska ge 409 och inte ändra något
+func TestRollbackProductEditedAfterImport(t *testing.T) {
+	db := testDB(t)
+
+	importID := createTestImport(t, db, importModeUpsert)
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "1", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "2", "Dämpare", "Testimportören"},
+	}), false, importOptions{importID: importID})
+
+	var categoryID int
+	if err := db.QueryRow(`SELECT category_id FROM products WHERE id = 'KT1'`).Scan(&categoryID); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"name": "Fjäder, ändrad", "category_id": ` + strconv.Itoa(categoryID) + `}`
+	rec := callHandler(updateProductHandler(db, false), http.MethodPut, "/products/KT1", body, map[string]string{"id": "KT1"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /products/KT1: %d %s", rec.Code, rec.Body)
+	}
+
+	id := strconv.Itoa(importID)
+	rec = callHandler(rollbackImportHandler(db), http.MethodPost, "/imports/"+id+"/rollback", "", map[string]string{"id": id})
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("rollback: %d %s, vill ha 409", rec.Code, rec.Body)
+	}
+
+	var failure RollbackFailure
+	if err := json.NewDecoder(rec.Body).Decode(&failure); err != nil {
+		t.Fatal(err)
+	}
+	want := []RollbackConflict{{Entity: changeProduct, ID: "KT1", Reason: "edited after the import"}}
+	if !reflect.DeepEqual(failure.Conflicts, want) {
+		t.Errorf("conflicts = %+v, vill ha %+v", failure.Conflicts, want)
+	}
+
+	var name, state string
+	if err := db.QueryRow(`SELECT name FROM products WHERE id = 'KT1'`).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Fjäder, ändrad" {
+		t.Errorf("name = %q, ändringen ska finnas kvar", name)
+	}
+	if err := db.QueryRow(`SELECT state FROM imports WHERE id = $1`, importID).Scan(&state); err != nil {
+		t.Fatal(err)
+	}
+	if state != jobSucceeded {
+		t.Errorf("state = %q, vill ha %q", state, jobSucceeded)
+	}
+}
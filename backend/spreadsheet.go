@@ -0,0 +1,553 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Kalkylbladsfiler läses direkt ur zip-arkivet med encoding/xml. Arket strömmas rad
+// för rad så att stora arbetsböcker inte behöver packas upp i minnet.
+
+// Största arket som Excel och LibreOffice kan spara (XFD1048576). Celler och
+// upprepningar utanför det avvisas i stället för att expanderas.
+const (
+	maxSheetColumns = 16384
+	maxSheetRows    = 1048576
+)
+
+// findSheet väljer ark på namn (skiftlägesokänsligt) eller på nummer där 1 är första
+// arket. Ett tomt val ger första arket.
+func findSheet(names []string, sheet string) (int, error) {
+	if len(names) == 0 {
+		return 0, errors.New("arbetsboken innehåller inga ark")
+	}
+
+	sheet = strings.TrimSpace(sheet)
+	if sheet == "" {
+		return 0, nil
+	}
+	for i, name := range names {
+		if strings.EqualFold(name, sheet) {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(sheet); err == nil && n >= 1 && n <= len(names) {
+		return n - 1, nil
+	}
+	return 0, fmt.Errorf("arket %q finns inte, arbetsboken innehåller: %s", sheet, strings.Join(names, ", "))
+}
+
+func openZipEntry(archive *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, f := range archive.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, fmt.Errorf("%s saknas i filen", name)
+}
+
+// --- XLSX ---
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText är text som antingen ligger direkt i <t> eller är uppdelad i formaterade <r>
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxRow struct {
+	// Num är radens nummer i arket. Det kan saknas och rader utan innehåll kan utelämnas.
+	Num   int `xml:"r,attr"`
+	Cells []struct {
+		Ref    string   `xml:"r,attr"`
+		Type   string   `xml:"t,attr"`
+		Value  string   `xml:"v"`
+		Inline xlsxText `xml:"is"`
+	} `xml:"c"`
+}
+
+// xlsxRowReader läser ett kalkylblad rad för rad
+type xlsxRowReader struct {
+	dec     *xml.Decoder
+	strings []string
+	// num är numret på den senast lästa raden, som i Excel
+	num int
+}
+
+func (x *xlsxRowReader) RowNumber() int {
+	return x.num
+}
+
+// xlsxreader öppnar ett ark i en XLSX-arbetsbok och läser headern
+func xlsxreader(file io.ReaderAt, size int64, sheet string, profile ImportProfile) (*importSource, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("filen är inte en giltig XLSX-fil: %w", err)
+	}
+
+	var workbook xlsxWorkbook
+	if err := decodeZipXML(archive, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := decodeZipXML(archive, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(workbook.Sheets))
+	for i, s := range workbook.Sheets {
+		names[i] = s.Name
+	}
+	idx, err := findSheet(names, sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	var target string
+	for _, rel := range rels.Relationships {
+		if rel.ID == workbook.Sheets[idx].RID {
+			target = rel.Target
+		}
+	}
+	if target == "" {
+		return nil, fmt.Errorf("arket %q saknas i filen", names[idx])
+	}
+	if strings.HasPrefix(target, "/") {
+		target = strings.TrimPrefix(target, "/")
+	} else {
+		target = path.Join("xl", target)
+	}
+
+	shared, err := readSharedStrings(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	// Arket strömmas efter att funktionen returnerat och stängs med importSource.Close
+	entry, err := openZipEntry(archive, target)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &xlsxRowReader{dec: xml.NewDecoder(entry), strings: shared}
+	src, err := newImportSource(rows, profile, FileFormat{Type: fileTypeXLSX, Sheet: names[idx]})
+	if err != nil {
+		entry.Close()
+		return nil, err
+	}
+	src.closer = entry
+	return src, nil
+}
+
+func decodeZipXML(archive *zip.Reader, name string, v any) error {
+	entry, err := openZipEntry(archive, name)
+	if err != nil {
+		return err
+	}
+	defer entry.Close()
+
+	if err := xml.NewDecoder(entry).Decode(v); err != nil {
+		return fmt.Errorf("kunde inte läsa %s: %w", name, err)
+	}
+	return nil
+}
+
+// readSharedStrings läser arbetsbokens gemensamma strängtabell, som celler av typen "s" pekar in i
+func readSharedStrings(archive *zip.Reader) ([]string, error) {
+	entry, err := openZipEntry(archive, "xl/sharedStrings.xml")
+	if err != nil {
+		// Arbetsböcker utan textceller saknar strängtabell
+		return nil, nil
+	}
+	defer entry.Close()
+
+	var shared []string
+	dec := xml.NewDecoder(entry)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return shared, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kunde inte läsa strängtabellen: %w", err)
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "si" {
+			continue
+		}
+		var si xlsxText
+		if err := dec.DecodeElement(&si, &se); err != nil {
+			return nil, fmt.Errorf("kunde inte läsa strängtabellen: %w", err)
+		}
+		shared = append(shared, si.String())
+	}
+}
+
+func (x *xlsxRowReader) Read() ([]string, error) {
+	for {
+		tok, err := x.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "row" {
+			continue
+		}
+		var row xlsxRow
+		if err := x.dec.DecodeElement(&row, &se); err != nil {
+			return nil, err
+		}
+		if row.Num > 0 {
+			x.num = row.Num
+		} else {
+			x.num++
+		}
+		// Tomma rader hoppas över precis som tomma rader i en CSV-fil
+		if len(row.Cells) == 0 {
+			continue
+		}
+
+		var values []string
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col, err = xlsxColumn(c.Ref)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var value string
+			switch c.Type {
+			case "s":
+				n, err := strconv.Atoi(c.Value)
+				if err != nil || n < 0 || n >= len(x.strings) {
+					return nil, fmt.Errorf("cell %s pekar på en okänd sträng", c.Ref)
+				}
+				value = x.strings[n]
+			case "inlineStr":
+				value = c.Inline.String()
+			default:
+				value = c.Value
+			}
+
+			for len(values) <= col {
+				values = append(values, "")
+			}
+			values[col] = value
+		}
+		return values, nil
+	}
+}
+
+// xlsxColumn översätter en cellreferens som "C12" till ett nollbaserat kolumnindex.
+// Kolumner efter XFD avvisas.
+func xlsxColumn(ref string) (int, error) {
+	col := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		col = col*26 + int(r-'A') + 1
+		if col > maxSheetColumns {
+			return 0, fmt.Errorf("cellreferensen %q ligger efter sista kolumnen XFD", ref)
+		}
+	}
+	if col == 0 {
+		return 0, fmt.Errorf("ogiltig cellreferens %q", ref)
+	}
+	return col - 1, nil
+}
+
+// --- ODS ---
+
+// odsCell är en cell i ett OpenDocument-kalkylblad. Sammanslagna celler
+// (covered-table-cell) läses som tomma.
+type odsCell struct {
+	XMLName      xml.Name
+	Repeat       int       `xml:"number-columns-repeated,attr"`
+	ValueType    string    `xml:"value-type,attr"`
+	Value        string    `xml:"value,attr"`
+	DateValue    string    `xml:"date-value,attr"`
+	BooleanValue string    `xml:"boolean-value,attr"`
+	Paragraphs   []odsText `xml:"p"`
+}
+
+type odsRow struct {
+	Repeat int       `xml:"number-rows-repeated,attr"`
+	Cells  []odsCell `xml:",any"`
+}
+
+// odsText samlar texten i ett <text:p>, inklusive formaterade delar och kodade mellanslag
+type odsText string
+
+func (t *odsText) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var b strings.Builder
+	depth := 1
+	for depth > 0 {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			b.Write(tok)
+		case xml.StartElement:
+			depth++
+			switch tok.Name.Local {
+			case "s":
+				n := 1
+				for _, a := range tok.Attr {
+					if a.Name.Local == "c" {
+						n, _ = strconv.Atoi(a.Value)
+					}
+				}
+				b.WriteString(strings.Repeat(" ", max(n, 1)))
+			case "tab":
+				b.WriteByte('\t')
+			case "line-break":
+				b.WriteByte('\n')
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+	*t = odsText(b.String())
+	return nil
+}
+
+func (c odsCell) String() string {
+	switch c.ValueType {
+	case "float", "percentage", "currency":
+		return c.Value
+	case "date":
+		return c.DateValue
+	case "boolean":
+		return c.BooleanValue
+	}
+	parts := make([]string, len(c.Paragraphs))
+	for i, p := range c.Paragraphs {
+		parts[i] = string(p)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// odsRowReader läser rader ur ett ark i content.xml. Upprepade rader
+// (number-rows-repeated) lämnas ut en gång per upprepning.
+type odsRowReader struct {
+	dec     *xml.Decoder
+	pending []string
+	repeat  int
+	// num är numret på den senast lästa raden i arket, inklusive upprepningar och
+	// tomma rader som hoppats över
+	num int
+}
+
+func (o *odsRowReader) RowNumber() int {
+	return o.num
+}
+
+// odsreader öppnar ett ark i en ODS-arbetsbok och läser headern
+func odsreader(file io.ReaderAt, size int64, sheet string, profile ImportProfile) (*importSource, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("filen är inte en giltig ODS-fil: %w", err)
+	}
+
+	// Arknamnen står först i varje <table:table>, så content.xml läses två gånger:
+	// en gång för att hitta arket och en gång för att strömma dess rader.
+	names, err := odsSheetNames(archive)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := findSheet(names, sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Arket strömmas efter att funktionen returnerat och stängs med importSource.Close
+	entry, err := openZipEntry(archive, "content.xml")
+	if err != nil {
+		return nil, err
+	}
+	dec := xml.NewDecoder(entry)
+	if err := skipToTable(dec, idx); err != nil {
+		entry.Close()
+		return nil, err
+	}
+
+	rows := &odsRowReader{dec: dec}
+	src, err := newImportSource(rows, profile, FileFormat{Type: fileTypeODS, Sheet: names[idx]})
+	if err != nil {
+		entry.Close()
+		return nil, err
+	}
+	src.closer = entry
+	return src, nil
+}
+
+func odsSheetNames(archive *zip.Reader) ([]string, error) {
+	entry, err := openZipEntry(archive, "content.xml")
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Close()
+
+	var names []string
+	dec := xml.NewDecoder(entry)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("kunde inte läsa content.xml: %w", err)
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "table" {
+			continue
+		}
+		for _, a := range se.Attr {
+			if a.Name.Local == "name" {
+				names = append(names, a.Value)
+			}
+		}
+		// Arkets innehåll behövs inte här
+		if err := dec.Skip(); err != nil {
+			return nil, fmt.Errorf("kunde inte läsa content.xml: %w", err)
+		}
+	}
+}
+
+// skipToTable läser fram till början av ark nummer idx (nollbaserat)
+func skipToTable(dec *xml.Decoder, idx int) error {
+	for n := 0; ; {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("kunde inte läsa content.xml: %w", err)
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "table" {
+			continue
+		}
+		if n == idx {
+			return nil
+		}
+		n++
+		if err := dec.Skip(); err != nil {
+			return fmt.Errorf("kunde inte läsa content.xml: %w", err)
+		}
+	}
+}
+
+func (o *odsRowReader) Read() ([]string, error) {
+	if o.repeat > 0 {
+		o.repeat--
+		o.num++
+		return o.pending, nil
+	}
+
+	for {
+		tok, err := o.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.EndElement:
+			if tok.Name.Local == "table" {
+				return nil, io.EOF
+			}
+		case xml.StartElement:
+			if tok.Name.Local != "table-row" {
+				continue
+			}
+			var row odsRow
+			if err := o.dec.DecodeElement(&row, &tok); err != nil {
+				return nil, err
+			}
+
+			values, err := odsValues(row)
+			if err != nil {
+				return nil, err
+			}
+			n := max(row.Repeat, 1)
+			// Tomma rader hoppas över, även de tusentals som kalkylprogram lägger sist i
+			// arket, men räknas så att radnumren stämmer
+			if len(values) == 0 {
+				o.num = min(o.num+min(n, maxSheetRows), maxSheetRows)
+				continue
+			}
+			if n > maxSheetRows-o.num {
+				return nil, fmt.Errorf("arket har fler än %d rader", maxSheetRows)
+			}
+			o.num++
+			if n > 1 {
+				o.pending = values
+				o.repeat = n - 1
+			}
+			return values, nil
+		}
+	}
+}
+
+// odsValues expanderar upprepade celler och tar bort tomma celler i slutet av raden.
+// En rad med innehåll efter sista kolumnen XFD avvisas.
+func odsValues(row odsRow) ([]string, error) {
+	var values []string
+	empty := 0
+	for _, c := range row.Cells {
+		n := max(c.Repeat, 1)
+		value := c.String()
+		if value == "" {
+			// Tomma celler läggs bara till om något kommer efter dem
+			empty = min(empty+min(n, maxSheetColumns), maxSheetColumns)
+			continue
+		}
+		if n > maxSheetColumns-len(values)-empty {
+			return nil, fmt.Errorf("raden har fler än %d kolumner", maxSheetColumns)
+		}
+		for ; empty > 0; empty-- {
+			values = append(values, "")
+		}
+		for i := 0; i < n; i++ {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// testXLSX bygger en arbetsbok med ett ark vars innehåll är sheetData
+func testXLSX(t *testing.T, sheetData string) []byte {
+	t.Helper()
+
+	files := []struct{ name, body string }{
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+	<sheets><sheet name="Blad1" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+	<Relationship Id="rId1" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+		{"xl/worksheets/sheet1.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+	<sheetData>` + sheetData + `</sheetData>
+</worksheet>`},
+	}
+
+	return testZip(t, files)
+}
+
+// testODS bygger en arbetsbok med ett ark vars rader är tableRows
+func testODS(t *testing.T, tableRows string) []byte {
+	t.Helper()
+
+	return testZip(t, []struct{ name, body string }{
+		{"content.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	xmlns:table="urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+	<office:body><office:spreadsheet>
+		<table:table table:name="Blad1">` + tableRows + `</table:table>
+	</office:spreadsheet></office:body>
+</office:document-content>`},
+	})
+}
+
+func testZip(t *testing.T, files []struct{ name, body string }) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(fw, f.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func inlineCell(ref, value string) string {
+	return `<c r="` + ref + `" t="inlineStr"><is><t>` + value + `</t></is></c>`
+}
+
+func odsTextCell(value string) string {
+	return `<table:table-cell office:value-type="string"><text:p>` + value + `</text:p></table:table-cell>`
+}
+
+// sheetProfile läser kategorin och koden ur kolumnerna med de namnen
+var sheetProfile = ImportProfile{
+	Name:              "test",
+	CategoryColumn:    "Kategori",
+	BrandColumn:       "Kategori",
+	ModelColumn:       "Kategori",
+	YearsColumn:       "Kategori",
+	ProductCodeColumn: "Kod",
+	ProductNameColumn: "Kod",
+	ImporterColumn:    "Kod",
+}
+
+type sheetRow struct {
+	num    int
+	values []string
+}
+
+// checkSheetRows läser alla rader efter headern och jämför dem och deras radnummer med want
+func checkSheetRows(t *testing.T, rows rowReader, want []sheetRow) {
+	t.Helper()
+
+	rowNum := 1
+	for _, w := range want {
+		var row []string
+		var err error
+		row, rowNum, err = readRow(rows, rowNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rowNum != w.num {
+			t.Errorf("radnummer = %d, vill ha %d", rowNum, w.num)
+		}
+		if !reflect.DeepEqual(row, w.values) {
+			t.Errorf("rad %d = %q, vill ha %q", w.num, row, w.values)
+		}
+	}
+	if _, _, err := readRow(rows, rowNum); err != io.EOF {
+		t.Errorf("fick %v efter sista raden, vill ha io.EOF", err)
+	}
+}
+
+// Tomma rader, både utelämnade och utan celler, ska räknas så att radnumren i
+// rapporten stämmer med Excel
+func TestXLSXRowNumbers(t *testing.T) {
+	file := testXLSX(t, `
+		<row r="1">`+inlineCell("A1", "Kategori")+inlineCell("B1", "Kod")+`</row>
+		<row r="2">`+inlineCell("A2", "Fjädrar")+inlineCell("B2", "1")+`</row>
+		<row r="3"/>
+		<row r="5">`+inlineCell("A5", "Fjädrar")+inlineCell("C5", "2")+`</row>
+		<row>`+inlineCell("A6", "Dämpare")+`</row>`)
+
+	src, err := xlsxreader(bytes.NewReader(file), int64(len(file)), "", sheetProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	checkSheetRows(t, src.rows, []sheetRow{
+		{2, []string{"Fjädrar", "1"}},
+		{5, []string{"Fjädrar", "", "2"}},
+		{6, []string{"Dämpare"}},
+	})
+}
+
+// Upprepade rader och tomma rader som hoppas över ska räknas som i LibreOffice
+func TestODSRowNumbers(t *testing.T) {
+	file := testODS(t, `
+		<table:table-row>`+odsTextCell("Kategori")+odsTextCell("Kod")+`</table:table-row>
+		<table:table-row>`+odsTextCell("Fjädrar")+odsTextCell("1")+`</table:table-row>
+		<table:table-row table:number-rows-repeated="2"><table:table-cell table:number-columns-repeated="3"/></table:table-row>
+		<table:table-row table:number-rows-repeated="2">`+odsTextCell("Dämpare")+`<table:table-cell/>`+odsTextCell("2")+`</table:table-row>
+		<table:table-row><table:table-cell/></table:table-row>
+		<table:table-row>`+odsTextCell("Länkar")+odsTextCell("3")+`</table:table-row>
+		<table:table-row table:number-rows-repeated="1048569"><table:table-cell table:number-columns-repeated="16384"/></table:table-row>`)
+
+	src, err := odsreader(bytes.NewReader(file), int64(len(file)), "", sheetProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	checkSheetRows(t, src.rows, []sheetRow{
+		{2, []string{"Fjädrar", "1"}},
+		{5, []string{"Dämpare", "", "2"}},
+		{6, []string{"Dämpare", "", "2"}},
+		{8, []string{"Länkar", "3"}},
+	})
+}
+
+func TestXLSXColumn(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    int
+		wantErr bool
+	}{
+		{"A1", 0, false},
+		{"Z9", 25, false},
+		{"AA10", 26, false},
+		{"XFD1", 16383, false},
+		{"XFE1", 0, true},
+		{"XFDXFDX1", 0, true},
+		{"ZZZZZZZZZZZZZZ1", 0, true},
+		{"1", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := xlsxColumn(tt.ref)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("xlsxColumn(%q): fel = %v, vill ha fel: %v", tt.ref, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("xlsxColumn(%q) = %d, vill ha %d", tt.ref, got, tt.want)
+		}
+	}
+}
+
+// Celler och rader utanför det största arket ska ge ett fel på raden i stället för
+// att expanderas
+func TestSheetLimits(t *testing.T) {
+	header := `<table:table-row>` + odsTextCell("Kategori") + odsTextCell("Kod") + `</table:table-row>`
+	tests := []struct {
+		name string
+		file func(t *testing.T) []byte
+		open func(file io.ReaderAt, size int64, sheet string, profile ImportProfile) (*importSource, error)
+	}{
+		{"xlsx kolumn efter XFD", func(t *testing.T) []byte {
+			return testXLSX(t, `<row r="1">`+inlineCell("A1", "Kategori")+inlineCell("B1", "Kod")+`</row>
+				<row r="2">`+inlineCell("ZZZZZZZZZZZZZZ2", "Fjädrar")+`</row>`)
+		}, xlsxreader},
+		{"ods upprepade celler", func(t *testing.T) []byte {
+			return testODS(t, header+`<table:table-row><table:table-cell office:value-type="string" table:number-columns-repeated="2000000000"><text:p>x</text:p></table:table-cell></table:table-row>`)
+		}, odsreader},
+		{"ods celler efter tomma celler", func(t *testing.T) []byte {
+			return testODS(t, header+`<table:table-row><table:table-cell table:number-columns-repeated="16384"/>`+odsTextCell("x")+`</table:table-row>`)
+		}, odsreader},
+		{"ods upprepade rader", func(t *testing.T) []byte {
+			return testODS(t, header+`<table:table-row table:number-rows-repeated="2000000000">`+odsTextCell("Fjädrar")+`</table:table-row>`)
+		}, odsreader},
+	}
+	for _, tt := range tests {
+		file := tt.file(t)
+		src, err := tt.open(bytes.NewReader(file), int64(len(file)), "", sheetProfile)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, _, err = readRow(src.rows, 1)
+		src.Close()
+		var rowErr *RowError
+		if !errors.As(err, &rowErr) || rowErr.Row != 2 {
+			t.Errorf("%s: fick %v, vill ha ett fel på rad 2", tt.name, err)
+		}
+	}
+}
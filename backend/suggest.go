@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Gränser för /suggest, som anropas för varje tangenttryckning
+const (
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 50
+	maxSuggestQuery     = 100
+)
+
+// suggestScore rankar ett värde mot sökningen: början av värdet går före en träff
+// mitt i, som går före en som bara liknar (pg_trgm). $1 är sökningen, $2 och $3 samma
+// sökning som LIKE-mönster för början och mitt i värdet.
+const suggestScore = `round((CASE WHEN %[1]s ILIKE $2 THEN 2 WHEN %[1]s ILIKE $3 THEN 1 ELSE 0 END
+	+ similarity(%[1]s, $1))::numeric, 3)`
+
+// suggestMatch är villkoret för en träff. Båda delarna kan använda trigramindexet för
+// värdet, så länge värdet är en kolumn med ett sådant index.
+const suggestMatch = `(%[1]s ILIKE $3 OR %[1]s %% $1)`
+
+// suggestSource är en av typerna som /suggest söker bland
+type suggestSource struct {
+	kind   string
+	id     string
+	label  string
+	detail string
+	from   string
+	// match är kolumnerna som jämförs med sökningen, label om tom. Varje kolumn får en
+	// egen delfråga så att dess trigramindex kan användas.
+	match []string
+	where string
+}
+
+var suggestSources = []suggestSource{
+	{kind: "brand", id: "b.id", label: "b.name", detail: "''", from: "brands b"},
+	// Modeller hittas på sitt eget namn eller på märkets, så "ktm" ger KTM:s modeller
+	{
+		kind: "model", id: "mo.id", label: "mo.name", detail: "b.name",
+		from:  "models mo JOIN brands b ON b.id = mo.brand_id",
+		match: []string{"mo.name", "b.name"},
+	},
+	{kind: "motorcycle", id: "m.id", label: "m.full_name", detail: "''", from: "motorcycles m", where: "m.full_name IS NOT NULL"},
+	{kind: "category", id: "c.id", label: "c.name", detail: "''", from: "categories c"},
+	{kind: "product", id: "p.id", label: "p.id", detail: "p.name", from: "products p", where: "p.discontinued_at IS NULL"},
+}
+
+// suggestQuery bygger en fråga med de bästa träffarna av varje typ och kolumn och
+// rankar dem tillsammans. En post som matchar på flera kolumner tas med en gång, med
+// sitt bästa värde. $4 är antalet träffar.
+func suggestQuery() string {
+	var parts []string
+	for _, s := range suggestSources {
+		match := s.match
+		if len(match) == 0 {
+			match = []string{s.label}
+		}
+		for _, col := range match {
+			where := fmt.Sprintf(suggestMatch, col)
+			if s.where != "" {
+				where += " AND " + s.where
+			}
+			parts = append(parts, fmt.Sprintf(`(
+				SELECT '%s' AS kind, %s::text AS id, %s AS label, %s AS detail, %s AS score
+				FROM %s
+				WHERE %s
+				ORDER BY score DESC
+				LIMIT $4
+			)`, s.kind, s.id, s.label, s.detail, fmt.Sprintf(suggestScore, col), s.from, where))
+		}
+	}
+	return `SELECT kind, id, label, detail, score FROM (
+			SELECT DISTINCT ON (kind, id) kind, id, label, detail, score
+			FROM (` + strings.Join(parts, " UNION ALL ") + `) s
+			ORDER BY kind, id, score DESC
+		) s
+		ORDER BY score DESC, length(label), label
+		LIMIT $4`
+}
+
+// likePattern skyddar tecknen som har en betydelse i LIKE-mönster
+var likePattern = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// suggestHandler föreslår märken, modeller, motorcyklar, kategorier och
+// produktnummer som matchar det användaren har skrivit hittills
+func suggestHandler(db *sql.DB) http.HandlerFunc {
+	query := suggestQuery()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		switch {
+		case q == "":
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		case utf8.RuneCountInString(q) > maxSuggestQuery:
+			http.Error(w, fmt.Sprintf("q can be at most %d characters", maxSuggestQuery), http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultSuggestLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxSuggestLimit {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSuggestLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		escaped := likePattern.Replace(q)
+		rows, err := db.Query(query, q, escaped+"%", "%"+escaped+"%", limit)
+		if err != nil {
+			log.Printf("Database query error: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		suggestions := []Suggestion{}
+		for rows.Next() {
+			var s Suggestion
+			if err := rows.Scan(&s.Kind, &s.ID, &s.Label, &s.Detail, &s.Score); err != nil {
+				log.Printf("Error scanning row: %v", err)
+				http.Error(w, "Error scanning row", http.StatusInternalServerError)
+				return
+			}
+			suggestions = append(suggestions, s)
+		}
+
+		json.NewEncoder(w).Encode(suggestions)
+	}
+}
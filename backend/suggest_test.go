@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		q, want string
+	}{
+		{"ktm", "ktm"},
+		{"100%", `100\%`},
+		{"sx_f", `sx\_f`},
+		{`a\b`, `a\\b`},
+		{`%_\`, `\%\_\\`},
+		{`\%`, `\\\%`},
+		{"Fjäder 2 x", "Fjäder 2 x"},
+	}
+	for _, tt := range tests {
+		if got := likePattern.Replace(tt.q); got != tt.want {
+			t.Errorf("likePattern.Replace(%q) = %q, vill ha %q", tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Importlägen. upsert lägger bara till och uppdaterar; sync gör dessutom katalogen
+// lik filen genom att ta bort det som inte längre finns med.
+const (
+	importModeUpsert = "upsert"
+	importModeSync   = "sync"
+)
+
+// Åtgärder som bara en sync gör
+const (
+	changeDiscontinued = "discontinued"
+	changeDeleted      = "deleted"
+)
+
+type fitmentKey struct {
+	productID    string
+	motorcycleID int
+}
+
+// syncSet samlar vilka produkter, importörer och kopplingar filen innehåller
+type syncSet struct {
+	products  map[string]bool
+	importers map[string]bool
+	fitments  map[fitmentKey]bool
+	// held är produkter med rader som hölls för granskning eller inte gick att
+	// importera. Deras kopplingar är okända och lämnas orörda.
+	held map[string]bool
+}
+
+func newSyncSet() *syncSet {
+	return &syncSet{
+		products:  make(map[string]bool),
+		importers: make(map[string]bool),
+		fitments:  make(map[fitmentKey]bool),
+		held:      make(map[string]bool),
+	}
+}
+
+// add registrerar en rad ur filen. Även felaktiga rader räknas så att en dry-run inte
+// visar deras produkter som utgångna, men de räknas som hållna eftersom deras
+// motorcyklar inte är kända.
+func (s *syncSet) add(r csvRow, motorcycleIDs []int, held bool) {
+	if r.productID == "" {
+		return
+	}
+	s.products[r.productID] = true
+	if held {
+		s.held[r.productID] = true
+	}
+	if r.importerName != "" {
+		s.importers[r.importerName] = true
+	}
+	for _, id := range motorcycleIDs {
+		s.fitments[fitmentKey{r.productID, id}] = true
+	}
+}
+
+// syncCatalog tar bort kopplingar som inte längre finns i filen för filens produkter och
+// markerar produkter som saknas i filen som utgångna. Bara produkter under
+// rotkategorin från samma importörer som i filen berörs.
+func syncCatalog(q queryer, rootCatID int, seen *syncSet) ([]importChange, error) {
+	var rootPath string
+	if err := q.QueryRow(`SELECT path FROM categories WHERE id = $1`, rootCatID).Scan(&rootPath); err != nil {
+		return nil, fmt.Errorf("kunde inte hämta root kategori: %w", err)
+	}
+
+	products := make([]string, 0, len(seen.products))
+	for id := range seen.products {
+		products = append(products, id)
+	}
+	importers := make([]string, 0, len(seen.importers))
+	for name := range seen.importers {
+		importers = append(importers, name)
+	}
+	synced := make([]string, 0, len(seen.products))
+	for id := range seen.products {
+		if !seen.held[id] {
+			synced = append(synced, id)
+		}
+	}
+	fitmentProducts := make([]string, 0, len(seen.fitments))
+	fitmentMotorcycles := make([]int64, 0, len(seen.fitments))
+	for f := range seen.fitments {
+		fitmentProducts = append(fitmentProducts, f.productID)
+		fitmentMotorcycles = append(fitmentMotorcycles, int64(f.motorcycleID))
+	}
+
+	var changes []importChange
+
+	rows, err := q.Query(`
+		DELETE FROM product_compatibility pc
+		WHERE pc.product_id = ANY($1)
+		AND NOT EXISTS (
+			SELECT 1 FROM unnest($2::text[], $3::int[]) AS f(product_id, motorcycle_id)
+			WHERE f.product_id = pc.product_id AND f.motorcycle_id = pc.motorcycle_id
+		)
+		RETURNING pc.product_id, pc.motorcycle_id
+	`, pq.Array(synced), pq.Array(fitmentProducts), pq.Array(fitmentMotorcycles))
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte ta bort kopplingar: %w", err)
+	}
+	for rows.Next() {
+		c := importChange{entity: changeFitment, action: changeDeleted}
+		if err := rows.Scan(&c.entityID, &c.relatedID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(`
+		UPDATE products p SET discontinued_at = now()
+		FROM categories c
+		WHERE c.id = p.category_id
+		AND c.path LIKE $1 || '%'
+		AND p.importer_name = ANY($2)
+		AND p.discontinued_at IS NULL
+		AND NOT (p.id = ANY($3))
+		RETURNING p.id
+	`, rootPath, pq.Array(importers), pq.Array(products))
+	if err != nil {
+		return nil, fmt.Errorf("kunde inte markera utgångna produkter: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := importChange{entity: changeProduct, action: changeDiscontinued}
+		if err := rows.Scan(&c.entityID); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func newImportDiff() *ImportDiff {
+	return &ImportDiff{
+		ProductsAdded:        []string{},
+		ProductsChanged:      []string{},
+		ProductsDiscontinued: []string{},
+		FitmentsAdded:        []Fitment{},
+		FitmentsRemoved:      []Fitment{},
+	}
+}
+
+// add sorterar in en ändring i diffen. Kategorier, märken, modeller och motorcyklar
+// syns redan i radutfallen och tas inte med.
+func (d *ImportDiff) add(c importChange) {
+	switch {
+	case c.entity == changeProduct && c.action == changeCreated:
+		d.ProductsAdded = append(d.ProductsAdded, c.entityID)
+	case c.entity == changeProduct && c.action == changeUpdated:
+		d.ProductsChanged = append(d.ProductsChanged, c.entityID)
+	case c.entity == changeProduct && c.action == changeDiscontinued:
+		d.ProductsDiscontinued = append(d.ProductsDiscontinued, c.entityID)
+	case c.entity == changeFitment && c.action == changeCreated:
+		d.FitmentsAdded = append(d.FitmentsAdded, Fitment{ProductID: c.entityID, MotorcycleID: c.relatedID})
+	case c.entity == changeFitment && c.action == changeDeleted:
+		d.FitmentsRemoved = append(d.FitmentsRemoved, Fitment{ProductID: c.entityID, MotorcycleID: c.relatedID})
+	}
+}
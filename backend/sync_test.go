@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// En rad med felaktiga årsmodeller säger inget om vilka motorcyklar produkten passar,
+// så en sync får inte ta bort produktens befintliga kopplingar
+func TestSyncKeepsFitmentsOfFailedRows(t *testing.T) {
+	db := testDB(t)
+
+	importTestFile(t, db, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "200", "Dämpare", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "300", "Länk", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "2019-2021", "300", "Länk", "Testimportören"},
+	}), false, importOptions{})
+
+	var sx250 int
+	if err := db.QueryRow(`SELECT id FROM motorcycles WHERE full_name = 'KTM SX 250 2019-2021'`).Scan(&sx250); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	report, err := runTestImport(t, tx, testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 250", "abc", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "abc", "200", "Dämpare", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "300", "Länk", "Testimportören"},
+	}), false, importOptions{dryRun: true, sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.RowsFailed != 2 {
+		t.Errorf("rows_failed = %d, vill ha 2", report.RowsFailed)
+	}
+	// Bara KT300, vars alla rader gick att läsa, tappar sin koppling
+	want := []Fitment{{ProductID: "KT300", MotorcycleID: sx250}}
+	if !reflect.DeepEqual(report.Diff.FitmentsRemoved, want) {
+		t.Errorf("fitments_removed = %+v, vill ha %+v", report.Diff.FitmentsRemoved, want)
+	}
+	if len(report.Diff.ProductsDiscontinued) != 0 {
+		t.Errorf("products_discontinued = %v, vill ha inga", report.Diff.ProductsDiscontinued)
+	}
+}
@@ -37,11 +37,17 @@ func readCSVRecords(records [][]string) {
 		productCode := "KT" + row[9]
 		productName := row[10]
 
-		startYear, endYear := parseModelYears(modYears)
-
-		fmt.Println("Category:", subCategoryName, "Bike brand name:", brandName,
-			"Bike model:", modelName, "Model year:", startYear, "-", endYear,
-			"Product code:", productCode, "Product name:", productName, "\n")
+		years, err := parseModelYears(modYears)
+		if err != nil {
+			fmt.Println("Error: ", err)
+		}
+
+		for _, y := range years {
+			fmt.Println("Category:", subCategoryName, "Bike brand name:", brandName,
+				"Bike model:", modelName, "Model year:", y.StartYear, "-", y.EndYear,
+				"Product code:", productCode, "Product name:", productName)
+		}
+		fmt.Println()
 
 	}
 }
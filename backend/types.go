@@ -1,6 +1,9 @@
 package main
 
-import "database/sql"
+import (
+	"database/sql"
+	"time"
+)
 
 type Brand struct {
 	ID   int    `json:"id"`
@@ -13,6 +16,13 @@ type Model struct {
 	Name    string `json:"name"`
 }
 
+// Alias är ett alternativt namn för ett märke eller en modell som importen känner igen
+type Alias struct {
+	ID         int    `json:"id"`
+	Alias      string `json:"alias"`
+	Normalized string `json:"normalized"`
+}
+
 type Motorcycle struct {
 	ID        int    `json:"id"`
 	Brand     string `json:"brand"`
@@ -21,17 +31,58 @@ type Motorcycle struct {
 	EndYear   int    `json:"end_year"`
 }
 
+// MotorcyclePage är en sida av motorcyklarna som en produkt passar
+type MotorcyclePage struct {
+	Items []Motorcycle `json:"items"`
+	Total int          `json:"total"`
+}
+
 type Product struct {
-	ID           string       `json:"id"`
-	Name         string       `json:"name"`
-	CategoryID   int          `json:"category_id"`
-	CategoryName string       `json:"category_name"`
-	CategoryPath string       `json:"category_path"`
-	Description  string       `json:"description"`
-	ForBrand     string       `json:"for_brand"`
-	IsUniversal  bool         `json:"is_universal"`
-	ImporterName string       `json:"importer_name"`
-	Motorcycles  []Motorcycle `json:"motorcycles"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	CategoryID   int    `json:"category_id"`
+	CategoryName string `json:"category_name"`
+	CategoryPath string `json:"category_path"`
+	Description  string `json:"description"`
+	ForBrand     string `json:"for_brand"`
+	IsUniversal  bool   `json:"is_universal"`
+	ImporterName string `json:"importer_name"`
+	// FitType är exact för produkter till specifika motorcyklar och universal för
+	// universalprodukter, så att en sökning på motorcykel kan grupperas
+	FitType string `json:"fit_type"`
+	// DiscontinuedAt är satt när en synkimport har markerat produkten som utgången
+	DiscontinuedAt *time.Time `json:"discontinued_at,omitempty"`
+	// FitmentCount är det totala antalet motorcyklar, även när Motorcycles är begränsad
+	FitmentCount int `json:"fitment_count"`
+	// Relevance är hur väl produkten matchar q i /products, saknas utan q
+	Relevance   float64      `json:"relevance,omitempty"`
+	Motorcycles []Motorcycle `json:"motorcycles"`
+}
+
+// ProductPage är en sida av /products. NextCursor saknas på sista sidan.
+type ProductPage struct {
+	Items      []Product `json:"items"`
+	Total      int       `json:"total"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	// Facets är antalet produkter per värde för facetterna i facets, räknat på alla
+	// produkter som matchar filtren
+	Facets map[string][]FacetCount `json:"facets,omitempty"`
+}
+
+// FacetCount är antalet produkter med ett visst värde i en facett
+type FacetCount struct {
+	Value string `json:"value"`
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// Suggestion är en träff i /suggest. ID är en sträng eftersom produkternas id är det.
+type Suggestion struct {
+	Kind   string  `json:"kind"`
+	ID     string  `json:"id"`
+	Label  string  `json:"label"`
+	Detail string  `json:"detail,omitempty"`
+	Score  float64 `json:"score"`
 }
 
 type Category struct {
@@ -45,3 +96,183 @@ type ModelYearRange struct {
 	StartYear int `json:"startyear"`
 	EndYear   int `json:"endyear"`
 }
+
+type ImportProfile struct {
+	ID                int    `json:"id"`
+	Name              string `json:"name"`
+	CategoryColumn    string `json:"category_column"`
+	BrandColumn       string `json:"brand_column"`
+	ModelColumn       string `json:"model_column"`
+	YearsColumn       string `json:"years_column"`
+	ProductCodeColumn string `json:"product_code_column"`
+	ProductNameColumn string `json:"product_name_column"`
+	ImporterColumn    string `json:"importer_column"`
+	CodePrefix        string `json:"code_prefix"`
+	Delimiter         string `json:"delimiter"`
+	Encoding          string `json:"encoding"`
+}
+
+type CreatedEntity struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type RowResult struct {
+	Row       int             `json:"row"`
+	ProductID string          `json:"product_id,omitempty"`
+	Created   []CreatedEntity `json:"created,omitempty"`
+	Updated   bool            `json:"updated,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	// Mapped är märken och modeller som byttes mot ett befintligt namn
+	Mapped []string `json:"mapped,omitempty"`
+	// Held är satt när raden hölls för granskning på grund av ett okänt namn
+	Held string `json:"held,omitempty"`
+
+	// changes är det som behövs för att kunna rulla tillbaka raden
+	changes []importChange
+	// motorcycleIDs är motorcyklarna som raden kopplar produkten till, inga för universalprodukter
+	motorcycleIDs []int
+}
+
+// FileFormat beskriver hur filen lästes: filtyp, ark för kalkylblad och teckenkodning
+// och avgränsare för CSV. *Detected är satt när värdet hittades automatiskt i filen.
+type FileFormat struct {
+	Type              string `json:"type"`
+	Sheet             string `json:"sheet,omitempty"`
+	Encoding          string `json:"encoding,omitempty"`
+	Delimiter         string `json:"delimiter,omitempty"`
+	EncodingDetected  bool   `json:"encoding_detected"`
+	DelimiterDetected bool   `json:"delimiter_detected"`
+}
+
+type Fitment struct {
+	ProductID    string `json:"product_id"`
+	MotorcycleID int    `json:"motorcycle_id"`
+}
+
+// FitmentResult är produktens kopplingar efter en ändring via /products/{id}/fitments
+type FitmentResult struct {
+	ProductID   string       `json:"product_id"`
+	Added       int          `json:"added"`
+	Removed     int          `json:"removed"`
+	Motorcycles []Motorcycle `json:"motorcycles"`
+}
+
+// ImportDiff är vad en import lade till, ändrade och tog bort bland produkter och kopplingar
+type ImportDiff struct {
+	ProductsAdded        []string  `json:"products_added"`
+	ProductsChanged      []string  `json:"products_changed"`
+	ProductsDiscontinued []string  `json:"products_discontinued"`
+	FitmentsAdded        []Fitment `json:"fitments_added"`
+	FitmentsRemoved      []Fitment `json:"fitments_removed"`
+}
+
+type ImportReport struct {
+	DryRun              bool        `json:"dry_run"`
+	Profile             string      `json:"profile"`
+	Mode                string      `json:"mode"`
+	Format              *FileFormat `json:"format,omitempty"`
+	CreatedRootCategory string      `json:"created_root_category,omitempty"`
+	RowsTotal           int         `json:"rows_total"`
+	RowsCreated         int         `json:"rows_created"`
+	RowsUpdated         int         `json:"rows_updated"`
+	RowsSkipped         int         `json:"rows_skipped"`
+	RowsFailed          int         `json:"rows_failed"`
+	RowsHeld            int         `json:"rows_held"`
+	NewEntities         []RowResult `json:"new_entities"`
+	UpdatedProducts     []RowResult `json:"updated_products"`
+	Errors              []RowResult `json:"errors"`
+	HeldRows            []RowResult `json:"held_rows"`
+	// Suggestions är okända märken och modeller som liknar ett befintligt namn
+	Suggestions []NameSuggestion `json:"suggestions"`
+	Diff        *ImportDiff      `json:"diff,omitempty"`
+}
+
+// NameSuggestion är ett "menade du"-förslag för ett märke eller en modell som inte
+// fanns. Action är created, mapped eller held beroende på unknown_names och tröskeln.
+type NameSuggestion struct {
+	Kind       string  `json:"kind"`
+	Brand      string  `json:"brand,omitempty"`
+	Name       string  `json:"name"`
+	Suggestion string  `json:"suggestion"`
+	Similarity float64 `json:"similarity"`
+	Action     string  `json:"action"`
+	Rows       int     `json:"rows"`
+	FirstRow   int     `json:"first_row"`
+}
+
+type ImportFailure struct {
+	Error     string `json:"error"`
+	Row       int    `json:"row,omitempty"`
+	ProductID string `json:"product_id,omitempty"`
+}
+
+type Import struct {
+	ID             int        `json:"id"`
+	Filename       string     `json:"filename"`
+	Uploader       string     `json:"uploader"`
+	RootCategory   string     `json:"root_category"`
+	Profile        string     `json:"profile"`
+	Method         string     `json:"method"`
+	Mode           string     `json:"mode"`
+	UnknownNames   string     `json:"unknown_names"`
+	MatchThreshold float64    `json:"match_threshold"`
+	Format         FileFormat `json:"format"`
+	State          string     `json:"state"`
+	QueuedAt       time.Time  `json:"queued_at"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	RolledBackAt   *time.Time `json:"rolled_back_at,omitempty"`
+	DurationMS     int64      `json:"duration_ms"`
+	RowsPerSecond  float64    `json:"rows_per_second"`
+	// Förlopp räknat på hur stor del av filen som har lästs
+	BytesTotal      int64          `json:"bytes_total"`
+	BytesProcessed  int64          `json:"bytes_processed"`
+	ProgressPercent float64        `json:"progress_percent"`
+	RowsProcessed   int            `json:"rows_processed"`
+	RowsCreated     int            `json:"rows_created"`
+	RowsUpdated     int            `json:"rows_updated"`
+	RowsSkipped     int            `json:"rows_skipped"`
+	RowsFailed      int            `json:"rows_failed"`
+	RowsHeld        int            `json:"rows_held"`
+	Error           *ImportFailure `json:"error,omitempty"`
+}
+
+type ImportRow struct {
+	Row       int    `json:"row"`
+	Outcome   string `json:"outcome"`
+	ProductID string `json:"product_id"`
+	Message   string `json:"message"`
+}
+
+type RollbackResult struct {
+	ImportID int            `json:"import_id"`
+	State    string         `json:"state"`
+	Reverted map[string]int `json:"reverted"`
+}
+
+type RollbackConflict struct {
+	Entity string `json:"entity"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type RollbackFailure struct {
+	Error     string             `json:"error"`
+	Conflicts []RollbackConflict `json:"conflicts"`
+}
+
+// MergeResult beskriver en sammanslagning av dubbletter och sparas i merges
+type MergeResult struct {
+	ID          int      `json:"id"`
+	Entity      string   `json:"entity"`
+	SurvivorID  int      `json:"survivor_id"`
+	MergedIDs   []int    `json:"merged_ids"`
+	MergedNames []string `json:"merged_names"`
+	// Repointed är rader som flyttades till den kvarvarande posten och Merged rader
+	// som slogs ihop med en rad den redan hade, per typ (models, motorcycles, fitments, aliases)
+	Repointed map[string]int `json:"repointed"`
+	Merged    map[string]int `json:"merged"`
+	MergedBy  string         `json:"merged_by,omitempty"`
+	MergedAt  time.Time      `json:"merged_at"`
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Största tillåtna uppladdning. Filen strömmas till disk så storleken påverkar inte minnet
+const maxUploadSize = 1 << 30
+
+// Största tillåtna storlek på ett vanligt formulärfält
+const maxFormFieldSize = 64 << 10
+
+// uploadForm är formulärfälten och den uppladdade filen som sparats i en temporär fil
+type uploadForm struct {
+	fields   map[string]string
+	filename string
+	path     string
+	size     int64
+}
+
+func (f *uploadForm) value(name string) string {
+	return f.fields[name]
+}
+
+// readUploadForm strömmar multipart-bodyn del för del. Filen skrivs direkt till en
+// temporär fil i stället för att läsas in i minnet som med ParseMultipartForm.
+func readUploadForm(r *http.Request) (*uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse multipart form: %w", err)
+	}
+
+	form := &uploadForm{fields: make(map[string]string)}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.remove()
+			return nil, fmt.Errorf("could not parse multipart form: %w", err)
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			if form.path != "" {
+				form.remove()
+				return nil, errors.New("only one file can be uploaded at a time")
+			}
+			if err := form.spool(part); err != nil {
+				form.remove()
+				return nil, err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		if err != nil {
+			form.remove()
+			return nil, fmt.Errorf("could not read form field %s: %w", part.FormName(), err)
+		}
+		form.fields[part.FormName()] = string(value)
+	}
+
+	if form.path == "" {
+		return nil, errors.New("could not get file")
+	}
+	return form, nil
+}
+
+func (f *uploadForm) spool(part *multipart.Part) error {
+	tmp, err := os.CreateTemp("", "import-*.upload")
+	if err != nil {
+		return fmt.Errorf("could not store upload: %w", err)
+	}
+	defer tmp.Close()
+
+	f.filename = part.FileName()
+	f.path = tmp.Name()
+
+	f.size, err = io.Copy(tmp, part)
+	if err != nil {
+		return fmt.Errorf("could not store upload: %w", err)
+	}
+	return nil
+}
+
+// remove tar bort den temporära filen
+func (f *uploadForm) remove() {
+	if f.path == "" {
+		return
+	}
+	if err := os.Remove(f.path); err != nil {
+		log.Printf("Error removing upload %s: %v", f.path, err)
+	}
+}
+
+func uploadFileHandler(db *sql.DB, queue *importQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+		form, err := readUploadForm(r)
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, fmt.Sprintf("File is too large (max %d MB)", maxUploadSize>>20), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Filen tas bort när requesten är klar om den inte lämnas över till en import-worker
+		queued := false
+		defer func() {
+			if !queued {
+				form.remove()
+			}
+		}()
+
+		rootCategory := form.value("category")
+		if rootCategory == "" {
+			http.Error(w, "Category is required", http.StatusBadRequest)
+			return
+		}
+
+		fileType, ok := fileTypeOf(form.filename)
+		if !ok {
+			http.Error(w, "Only .csv, .xlsx and .ods files allowed", http.StatusBadRequest)
+			return
+		}
+
+		profileName := form.value("profile")
+		if profileName == "" {
+			profileName = defaultProfileName
+		}
+
+		profile, err := getImportProfile(db, profileName)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown import profile: "+profileName, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching import profile: %v", err)
+			http.Error(w, "Database query error", http.StatusInternalServerError)
+			return
+		}
+
+		dryRun := false
+		if v := form.value("dry_run"); v != "" {
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid dry_run value", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Avgränsare och teckenkodning kan anges per uppladdning och går då före profilen.
+		// De används bara för CSV-filer.
+		if v := form.value("encoding"); v != "" {
+			profile.Encoding = v
+			if !isAutoDetect(v) {
+				if _, err := profile.textEncoding(); err != nil {
+					http.Error(w, "Invalid encoding: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if v := form.value("delimiter"); v != "" {
+			profile.Delimiter = v
+			if !isAutoDetect(v) {
+				if _, err := profile.delimiterRune(); err != nil {
+					http.Error(w, "Invalid delimiter: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		bulk := false
+		if v := form.value("bulk"); v != "" {
+			bulk, err = strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid bulk value", http.StatusBadRequest)
+				return
+			}
+		}
+
+		mode := form.value("mode")
+		switch mode {
+		case "":
+			mode = importModeUpsert
+		case importModeUpsert, importModeSync:
+		default:
+			http.Error(w, "Invalid mode, expected upsert or sync", http.StatusBadRequest)
+			return
+		}
+
+		unknownNames := form.value("unknown_names")
+		switch unknownNames {
+		case "":
+			unknownNames = unknownNamesCreate
+		case unknownNamesCreate, unknownNamesMap, unknownNamesReview:
+		default:
+			http.Error(w, "Invalid unknown_names, expected create, map or review", http.StatusBadRequest)
+			return
+		}
+
+		matchThreshold, err := parseMatchThreshold(form.value("match_threshold"))
+		if err != nil {
+			http.Error(w, "Invalid match_threshold: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		task := importTask{
+			filename:       form.filename,
+			uploader:       form.value("uploader"),
+			path:           form.path,
+			size:           form.size,
+			format:         FileFormat{Type: fileType},
+			sheet:          form.value("sheet"),
+			rootCategory:   rootCategory,
+			profile:        profile,
+			bulk:           bulk,
+			sync:           mode == importModeSync,
+			unknownNames:   unknownNames,
+			matchThreshold: matchThreshold,
+		}
+
+		// Kontrollera att filen går att läsa och att profilen matchar headern innan jobbet köas
+		file, _, src, err := task.open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		defer src.Close()
+
+		// Workern läser filen med samma ark, kodning och avgränsare som hittades här
+		task.format = src.format
+		task.sheet = src.format.Sheet
+		task.profile.Encoding = src.format.Encoding
+		task.profile.Delimiter = src.format.Delimiter
+
+		if !dryRun {
+			imp, err := queue.enqueue(task)
+			if err == errQueueFull {
+				http.Error(w, "Import queue is full, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				log.Printf("Error queuing import: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			queued = true
+
+			w.Header().Set("Location", fmt.Sprintf("/imports/%d", imp.ID))
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(imp)
+			return
+		}
+
+		// Dry-run körs direkt i en transaktion som alltid rullas tillbaka
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Error starting transaction: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		report, err := insertFromCSV(tx, src.rows, src.cols, task.rootCategory, task.profile, importOptions{
+			dryRun:         true,
+			sync:           task.sync,
+			unknownNames:   task.unknownNames,
+			matchThreshold: task.matchThreshold,
+		})
+		if err != nil {
+			log.Println("Error when inserting: ", err)
+			writeImportFailure(w, err)
+			return
+		}
+		report.Format = &src.format
+
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// importFailure beskriver vilken rad som stoppade importen och varför
+func importFailure(err error) *ImportFailure {
+	failure := &ImportFailure{Error: err.Error()}
+
+	var rowErr *RowError
+	if errors.As(err, &rowErr) {
+		failure.Row = rowErr.Row
+		failure.ProductID = rowErr.ProductID
+		failure.Error = rowErr.Err.Error()
+	}
+	return failure
+}
+
+func writeImportFailure(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	var rowErr *RowError
+	if errors.As(err, &rowErr) && rowErr.Invalid {
+		status = http.StatusUnprocessableEntity
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(importFailure(err))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// uploadRequest bygger en POST /upload med filen och formulärfälten
+func uploadRequest(t *testing.T, filename, file string, fields map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(file)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+// catalogTables är tabellerna som en import kan skriva till
+var catalogTables = []string{
+	"categories", "products", "brands", "models", "motorcycles", "product_compatibility",
+	"imports", "import_rows", "import_changes",
+}
+
+// countRows räknar raderna i varje tabell i catalogTables
+func countRows(t *testing.T, db *sql.DB) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int, len(catalogTables))
+	for _, table := range catalogTables {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		counts[table] = n
+	}
+	return counts
+}
+
+// En dry-run ska rapportera vad importen skulle göra, även för felaktiga rader, men
+// inte lämna något kvar i databasen
+func TestUploadDryRunChangesNothing(t *testing.T) {
+	db := testDB(t)
+
+	file := testFile([]testRow{
+		{"Bakfjädrar", "KTM", "SX 125", "2019-2021", "100", "Fjäder", "Testimportören"},
+		{"Bakfjädrar", "KTM", "SX 125", "abc", "200", "Dämpare", "Testimportören"},
+		{"Framfjädrar", "Husqvarna", "TC 125", "2020+", "300", "Länk", "Testimportören"},
+	})
+	rec := httptest.NewRecorder()
+	uploadFileHandler(db, nil)(rec, uploadRequest(t, "test.csv", file, map[string]string{
+		"category": "fjädrar",
+		"dry_run":  "true",
+	}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /upload: %d %s", rec.Code, rec.Body)
+	}
+
+	var report ImportReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || report.RowsTotal != 3 || report.RowsCreated != 2 || report.RowsFailed != 1 {
+		t.Errorf("rapporten = dry_run %t, %d rader, %d skapade, %d misslyckade; vill ha dry_run, 3, 2, 1",
+			report.DryRun, report.RowsTotal, report.RowsCreated, report.RowsFailed)
+	}
+
+	for table, n := range countRows(t, db) {
+		if n != 0 {
+			t.Errorf("%s har %d rader efter dry-run, vill ha 0", table, n)
+		}
+	}
+}
@@ -5,7 +5,7 @@ import ProductTable from "@/components/producttable";
 import { Button } from "@/components/ui/button";
 import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/components/ui/card";
 import { Result, tryCatch } from "@/utils/trycatch";
-import { Brand, Category, Model, ModelYear, Product, UserInput } from "@/utils/types";
+import { Brand, Category, Model, ModelYear, Product, ProductPage, UserInput } from "@/utils/types";
 import axios from "axios";
 
 import { useEffect, useState } from "react";
@@ -23,6 +23,8 @@ export default function Home() {
   const [models, setModels] = useState<Model[]>([]);
   const [years, setYears] = useState<ModelYear[]>([]);
   const [products, setProducts] = useState<Product[]>([]);
+  const [total, setTotal] = useState(0);
+  const [nextCursor, setNextCursor] = useState<string | undefined>(undefined);
 
   // Fetching brands
   useEffect(() => {
@@ -88,7 +90,22 @@ export default function Home() {
       return;
     }
 
-    setProducts(data);
+    setProducts(data.items);
+    setTotal(data.total);
+    setNextCursor(data.next_cursor);
+  }
+
+  // Hämtar nästa sida och lägger till den i tabellen
+  async function loadMore() {
+    if (!nextCursor) return;
+    const { data, error } = await getFilteredProducts(userInput, nextCursor);
+    if (error !== null) {
+      console.error("Error when fetching products: ", error);
+      return;
+    }
+
+    setProducts((prev) => [...prev, ...data.items]);
+    setNextCursor(data.next_cursor);
   }
 
   return (
@@ -154,7 +171,12 @@ export default function Home() {
             </div>
           </CardContent>
         </Card>
-        <ProductTable products={products} />
+        <ProductTable products={products} total={total} />
+        {nextCursor && (
+          <Button variant="outline" onClick={loadMore}>
+            Visa fler
+          </Button>
+        )}
       </div>
     </>
   );
@@ -199,13 +221,26 @@ export async function getCategories(): Promise<Result<Category[], Error>> {
   return { data: data.data, error: null };
 }
 
-async function getFilteredProducts(input: UserInput): Promise<Result<Product[], Error>> {
+// Öppna intervall lagras som 0 och 9999 men skickas som "-2018" och "2019+"
+function formatYears(year: ModelYear): string {
+  if (year.startyear === year.endyear) return `${year.startyear}`;
+  if (year.endyear === 9999) return `${year.startyear}+`;
+  if (year.startyear === 0) return `-${year.endyear}`;
+  return `${year.startyear}-${year.endyear}`;
+}
+
+// Antal produkter som hämtas per sida
+const PRODUCTS_PER_REQUEST = 300;
+
+async function getFilteredProducts(input: UserInput, cursor?: string): Promise<Result<ProductPage, Error>> {
   const params = new URLSearchParams();
 
   if (input.brand) params.append("brand", input.brand.name);
   if (input.model) params.append("model", input.model.name);
-  if (input.year) params.append("year", `${input.year.startyear}-${input.year.endyear.toString().slice(0, 4)}`);
+  if (input.year) params.append("year", formatYears(input.year));
   if (input.category) params.append("category_id", input.category.id.toString());
+  params.append("limit", PRODUCTS_PER_REQUEST.toString());
+  if (cursor) params.append("cursor", cursor);
 
   const { data, error } = await tryCatch(axios.get(`http://localhost:8000/products?${params.toString()}`));
 
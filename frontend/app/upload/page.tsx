@@ -16,6 +16,13 @@ type Status = {
   success: String | null;
 };
 
+const supportedExtensions = [".csv", ".xlsx", ".ods"];
+
+function isSupportedFile(file: File) {
+  const name = file.name.toLowerCase();
+  return supportedExtensions.some((ext) => name.endsWith(ext));
+}
+
 export default function Page() {
   const [isDragging, setIsDragging] = useState(false);
   const [category, setCategory] = useState("");
@@ -28,7 +35,7 @@ export default function Page() {
     setIsDragging(false);
 
     const file = e.dataTransfer.files?.[0];
-    if (!file || !file.name.toLowerCase().endsWith(".csv")) return;
+    if (!file || !isSupportedFile(file)) return;
 
     setFileToUpload(file);
   };
@@ -37,7 +44,7 @@ export default function Page() {
     e.preventDefault();
 
     const file = e.target.files?.[0];
-    if (!file || !file.name.toLowerCase().endsWith(".csv")) return;
+    if (!file || !isSupportedFile(file)) return;
 
     setFileToUpload(file);
   }
@@ -98,9 +105,9 @@ export default function Page() {
                       <span>
                         <span className="text-blue-500 transition duration-300 ease-in-out">Klicka</span> eller dra & släpp för att ladda upp produktlista
                       </span>
-                      <span className="text-xs font-light text-muted-foreground">Format som stöds: .CSV</span>
+                      <span className="text-xs font-light text-muted-foreground">Format som stöds: .CSV, .XLSX, .ODS</span>
                     </Label>
-                    <Input type="file" accept=".csv" name="PDF-Upload" id="PDF-Upload" className="hidden appearance-none" onChange={UploadFile} />
+                    <Input type="file" accept=".csv,.xlsx,.ods" name="PDF-Upload" id="PDF-Upload" className="hidden appearance-none" onChange={UploadFile} />
                   </div>
                 ) : (
                   <div className="w-full h-full flex flex-col items-center justify-start gap-4">
@@ -160,7 +167,8 @@ async function UploadFileToBackend(file: File, rootCategory: string, setStatus:
 
   if (error !== null) {
     setStatus({ error: error, success: null });
+    return;
   }
 
-  setStatus({ error: null, success: "done" });
+  setStatus({ error: null, success: `Import ${data.data.id} köad` });
 }
@@ -5,7 +5,7 @@ import { Pagination, PaginationContent, PaginationEllipsis, PaginationItem, Pagi
 
 const PAGE_SIZE = 30;
 
-export default function ProductTable({ products }: { products: Product[] }) {
+export default function ProductTable({ products, total }: { products: Product[]; total: number }) {
   const [currentPage, setCurrentPage] = useState(1);
 
   const totalPages = Math.ceil(products.length / PAGE_SIZE);
@@ -50,8 +50,8 @@ export default function ProductTable({ products }: { products: Product[] }) {
                   <>Universal</>
                 ) : (
                   <>
-                    {product.motorcycles.length >= 10 ? (
-                      <>Fler än 10 st modeller</>
+                    {product.fitment_count > product.motorcycles.length ? (
+                      <>Passar {product.fitment_count} modeller</>
                     ) : (
                       <>
                         {product.motorcycles.map((moto) => {
@@ -73,7 +73,7 @@ export default function ProductTable({ products }: { products: Product[] }) {
         <TableFooter>
           <TableRow>
             <TableCell colSpan={6} className="font-bold text-center">
-              Totalt: {products.length} produkter hittade
+              Totalt: {total} produkter hittade
             </TableCell>
           </TableRow>
         </TableFooter>
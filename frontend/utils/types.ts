@@ -35,6 +35,17 @@ export type Motorcycle = {
   end_year: number;
 };
 
+export type MotorcyclePage = {
+  items: Motorcycle[];
+  total: number;
+};
+
+export type ProductPage = {
+  items: Product[];
+  total: number;
+  next_cursor?: string;
+};
+
 export type Product = {
   id: string;
   name: string;
@@ -43,6 +54,8 @@ export type Product = {
   category_id: number;
   category_path: string;
   is_universal: boolean;
+  fit_type: "exact" | "universal";
   motorcycles: Motorcycle[];
+  fitment_count: number;
   importer_name: string;
 };